@@ -0,0 +1,7 @@
+// Package snappy provide a snappy Compressor for the zip mode of ssdb.Client,
+// it live in its own package so the ssdb package keep no third-party dependency.
+//
+// The codec need github.com/golang/snappy, which the repo does not pin, so it is only
+// built with the snappy tag: go get github.com/golang/snappy then go build -tags snappy.
+// Without the tag the package is empty and go build ./... work on a clean checkout.
+package snappy
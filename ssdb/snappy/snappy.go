@@ -0,0 +1,25 @@
+//go:build snappy
+
+package snappy
+
+import (
+	"encoding/base64"
+
+	"github.com/golang/snappy"
+)
+
+// Compressor is snappy then base64, cheaper on CPU than the default gzip.
+// The server side must decode the "zip" payload with snappy as well.
+type Compressor struct{}
+
+func (Compressor) Compress(data []byte) string {
+	return base64.StdEncoding.EncodeToString(snappy.Encode(nil, data))
+}
+
+func (Compressor) Decompress(data string) ([]byte, error) {
+	zipData, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Decode(nil, zipData)
+}
@@ -0,0 +1,54 @@
+package ssdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+)
+
+// Compressor encode the command payload sent in zip mode and decode the zip replies,
+// the output of Compress must be text safe because it travel as one value on the wire
+type Compressor interface {
+	Compress(data []byte) string
+	Decompress(data string) ([]byte, error)
+}
+
+// GzipCompressor is the default codec, gzip then base64
+type GzipCompressor struct{}
+
+func (GzipCompressor) Compress(data []byte) string {
+	var zipbuf bytes.Buffer
+	w := gzip.NewWriter(&zipbuf)
+	w.Write(data)
+	w.Close()
+	return base64.StdEncoding.EncodeToString(zipbuf.Bytes())
+}
+
+func (GzipCompressor) Decompress(data string) ([]byte, error) {
+	zipData, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	zipReader, err := gzip.NewReader(bytes.NewReader(zipData))
+	if err != nil {
+		return nil, err
+	}
+	defer zipReader.Close()
+	return ioutil.ReadAll(zipReader)
+}
+
+// WithCompressor replace the gzip codec used in zip mode,
+// the payload is still marked "zip" on the wire so the server side must use the same codec.
+func WithCompressor(cp Compressor) Option {
+	return func(c *Client) {
+		c.compressor = cp
+	}
+}
+
+func (c *Client) codec() Compressor {
+	if c.compressor == nil {
+		return GzipCompressor{}
+	}
+	return c.compressor
+}
@@ -0,0 +1,102 @@
+package ssdb
+
+import (
+	"fmt"
+)
+
+// Iterator walk through a key range page by page with scan
+type Iterator struct {
+	c     *Client
+	cmd   string
+	start string
+	end   string
+	batch int
+	keys  []string
+	vals  []string
+	idx   int
+	key   string
+	value string
+	done  bool
+	err   error
+}
+
+// ScanIter return an iterator over (start, end] of the kv namespace,
+// each page fetches batch items and resumes after the last seen key.
+func (c *Client) ScanIter(start string, end string, batch int) *Iterator {
+	if batch <= 0 {
+		batch = 100
+	}
+	return &Iterator{c: c, cmd: "scan", start: start, end: end, batch: batch}
+}
+
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.idx >= len(it.keys) {
+		if it.done || !it.fetch() {
+			return false
+		}
+	}
+	it.key = it.keys[it.idx]
+	it.value = it.vals[it.idx]
+	it.idx++
+	return true
+}
+
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+func (it *Iterator) Value() string {
+	return it.value
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func (it *Iterator) fetch() bool {
+	resp, err := it.c.Do(it.cmd, it.start, it.end, it.batch)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	args := []interface{}{it.cmd, it.start, it.end, it.batch}
+	if status, _, err := ParseStatus(resp); status != StatusOK {
+		it.err = fmt.Errorf("%w args:%v", err, args)
+		return false
+	}
+	if len(resp)%2 != 1 {
+		it.err = fmt.Errorf("bad response:%v args:%v", resp, args)
+		return false
+	}
+	it.keys = it.keys[:0]
+	it.vals = it.vals[:0]
+	it.idx = 0
+	data := resp[1:]
+	for i := 0; i < len(data); i += 2 {
+		it.keys = append(it.keys, data[i])
+		it.vals = append(it.vals, data[i+1])
+	}
+	if len(it.keys) < it.batch {
+		it.done = true
+	}
+	if len(it.keys) == 0 {
+		return false
+	}
+	it.start = it.keys[len(it.keys)-1]
+	return true
+}
+
+// ForEach call fn for every key/value in (start, end] page by page, without holding the
+// whole range in memory. It stop at the first error of fn and return it.
+func (c *Client) ForEach(start string, end string, batch int, fn func(key, val string) error) error {
+	it := c.ScanIter(start, end, batch)
+	for it.Next() {
+		if err := fn(it.Key(), it.Value()); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
@@ -0,0 +1,152 @@
+package ssdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Pipe queue commands and send them back-to-back in one round trip
+type Pipe struct {
+	c    *Client
+	cmds [][]interface{}
+}
+
+type PipeResult struct {
+	Cmd   string
+	Data  []string
+	Error error
+}
+
+// Pipeline create a new pipe on this client, Exec run it between the Do of other goroutines.
+// A Pipe itself is not safe for concurrent use.
+func (c *Client) Pipeline() *Pipe {
+	return &Pipe{c: c}
+}
+
+func (p *Pipe) Do(args ...interface{}) *Pipe {
+	if len(args) > 0 {
+		p.cmds = append(p.cmds, args)
+	}
+	return p
+}
+
+func (p *Pipe) Set(key string, val string) *Pipe {
+	return p.Do("set", key, val)
+}
+
+func (p *Pipe) Get(key string) *Pipe {
+	return p.Do("get", key)
+}
+
+func (p *Pipe) Del(key string) *Pipe {
+	return p.Do("del", key)
+}
+
+func (p *Pipe) SetX(key string, val string, ttl int) *Pipe {
+	return p.Do("setx", key, val, ttl)
+}
+
+func (p *Pipe) Expire(key string, ttl int) *Pipe {
+	return p.Do("expire", key, ttl)
+}
+
+func (p *Pipe) Incr(key string, val int) *Pipe {
+	return p.Do("incr", key, val)
+}
+
+func (p *Pipe) Exists(key string) *Pipe {
+	return p.Do("exists", key)
+}
+
+func (p *Pipe) HashSet(hash string, key string, val string) *Pipe {
+	return p.Do("hset", hash, key, val)
+}
+
+func (p *Pipe) HashGet(hash string, key string) *Pipe {
+	return p.Do("hget", hash, key)
+}
+
+func (p *Pipe) HashDel(hash string, key string) *Pipe {
+	return p.Do("hdel", hash, key)
+}
+
+func (p *Pipe) HashIncr(hash string, key string, val int) *Pipe {
+	return p.Do("hincr", hash, key, val)
+}
+
+func (p *Pipe) HashExists(hash string, key string) *Pipe {
+	return p.Do("hexists", hash, key)
+}
+
+func (p *Pipe) HashSize(hash string) *Pipe {
+	return p.Do("hsize", hash)
+}
+
+// Len return the number of queued commands
+func (p *Pipe) Len() int {
+	return len(p.cmds)
+}
+
+// pipeJob follow the runId of a queued pipeline, processDo fill results while it run the commands
+type pipeJob struct {
+	cmds    [][]interface{}
+	results []PipeResult
+}
+
+// Exec write all queued commands then read exactly one response per command,
+// the pipeline is queued like one Do so the command timeout bound the whole round trip
+func (p *Pipe) Exec() ([]PipeResult, error) {
+	c := p.c
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return []PipeResult{}, nil
+	}
+	if err := c.lazyConnect(context.Background()); err != nil {
+		return nil, err
+	}
+	if !c.IsAlive() || !c.enter() {
+		if err := c.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Connection has closed.")
+	}
+	defer c.inflight.Done()
+	job := &pipeJob{cmds: cmds}
+	runId := c.newRunId()
+	result := c.roundTrip(context.Background(), runId, []interface{}{runId, job})
+	return job.results, result.Error
+}
+
+// doPipe run a pipeline on the processDo goroutine, it own the socket until every response is read
+func (c *Client) doPipe(job *pipeJob, timeout time.Duration) error {
+	c.mu.Lock()
+	connected := c.Connected
+	c.mu.Unlock()
+	if !connected {
+		return fmt.Errorf("lost ssdb connection")
+	}
+	c.setDeadline(timeout)
+	defer c.setDeadline(0)
+	err := c.sendAll(job.cmds)
+	if err != nil {
+		c.logf("SSDB Client[%s] Pipe Send Error:%v Data:%v\n", c.Id, err, job.cmds)
+		c.CheckError(err)
+		return wrapTimeout(err, timeout)
+	}
+	job.results = make([]PipeResult, 0, len(job.cmds))
+	for _, args := range job.cmds {
+		resp, err := c.recv()
+		if err != nil {
+			c.logf("SSDB Client[%s] Pipe Receive Error:%v Data:%v\n", c.Id, err, args)
+			c.CheckError(err)
+			return wrapTimeout(err, timeout)
+		}
+		c.warnLargeResponse(args)
+		result := PipeResult{Cmd: fmt.Sprintf("%v", args[0]), Data: resp}
+		_, _, result.Error = ParseStatus(resp)
+		job.results = append(job.results, result)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package ssdb
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha1"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// WithPinnedCert only accept a server whose leaf certificate has this sha256 fingerprint,
+// given in hex with or without ':' separators like the output of openssl x509 -fingerprint -sha256.
+// The pin is checked in addition to the normal chain verification, not instead of it.
+func WithPinnedCert(sha256Fingerprint string) Option {
+	return func(c *Client) {
+		c.tlsInfo.pinned = sha256Fingerprint
+	}
+}
+
+// WithRequireOCSPStaple fail the tls connection unless the server staple a good ocsp response
+// for its certificate, signed by the issuer or a responder it delegated and not expired.
+// A server with no stapling configured can not be connected with it.
+func WithRequireOCSPStaple(flag bool) Option {
+	return func(c *Client) {
+		c.tlsInfo.ocsp = flag
+	}
+}
+
+// harden add the checks of WithPinnedCert and WithRequireOCSPStaple to conf
+func (t *ClientTlsInfo) harden(conf *tls.Config) error {
+	if t.ocsp {
+		conf.VerifyConnection = verifyOCSPStaple
+	}
+	if t.pinned == "" {
+		return nil
+	}
+	want, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(t.pinned), ":", ""))
+	if err != nil || len(want) != sha256.Size {
+		return fmt.Errorf("%w: bad sha256 fingerprint %q", ErrBadArgument, t.pinned)
+	}
+	// run after the chain verification, which still reject an unknown CA
+	conf.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("%w: no certificate presented", ErrCertPinMismatch)
+		}
+		got := sha256.Sum256(rawCerts[0])
+		if !bytes.Equal(got[:], want) {
+			return fmt.Errorf("%w: got %s", ErrCertPinMismatch, hex.EncodeToString(got[:]))
+		}
+		return nil
+	}
+	return nil
+}
+
+// the ocsp types below follow RFC 6960, only what the staple check need is decoded
+
+var oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+// ocspSignatureAlgorithms map the signature oid of a response to the x509 algorithm checking it
+var ocspSignatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+	"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+	"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+	"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+	"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+	"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+	"1.3.101.112":           x509.PureEd25519,
+}
+
+// ocspHashAlgorithms map the hash oid of a CertID to the hash of its name and key
+var ocspHashAlgorithms = map[string]crypto.Hash{
+	"1.3.14.3.2.26":          crypto.SHA1,
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    ocspResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Raw            asn1.RawContent
+	Version        int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID asn1.RawValue
+	ProducedAt     time.Time `asn1:"generalized"`
+	Responses      []ocspSingleResponse
+}
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag       `asn1:"tag:0,optional"`
+	Revoked    ocspRevokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag       `asn1:"tag:2,optional"`
+	ThisUpdate time.Time       `asn1:"generalized"`
+	NextUpdate time.Time       `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time `asn1:"generalized"`
+}
+
+// verifyOCSPStaple run at the end of the handshake, after the chain verification
+func verifyOCSPStaple(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return fmt.Errorf("%w: no verified chain", ErrOCSPStaple)
+	}
+	chain := cs.VerifiedChains[0]
+	leaf, issuer := chain[0], chain[0]
+	if len(chain) > 1 {
+		issuer = chain[1]
+	}
+	if len(cs.OCSPResponse) == 0 {
+		return fmt.Errorf("%w: no staple from %s", ErrOCSPStaple, leaf.Subject)
+	}
+	single, err := parseOCSPStaple(cs.OCSPResponse, leaf, issuer)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrOCSPStaple, err)
+	}
+	now := time.Now()
+	if single.ThisUpdate.After(now) {
+		return fmt.Errorf("%w: response not valid before %v", ErrOCSPStaple, single.ThisUpdate)
+	}
+	if !single.NextUpdate.IsZero() && single.NextUpdate.Before(now) {
+		return fmt.Errorf("%w: response expired at %v", ErrOCSPStaple, single.NextUpdate)
+	}
+	switch {
+	case bool(single.Good):
+		return nil
+	case bool(single.Unknown):
+		return fmt.Errorf("%w: status unknown for serial %v", ErrOCSPStaple, leaf.SerialNumber)
+	default:
+		return fmt.Errorf("%w: serial %v at %v", ErrCertRevoked, leaf.SerialNumber, single.Revoked.RevocationTime)
+	}
+}
+
+// parseOCSPStaple check the signature of the staple and return the entry of leaf
+func parseOCSPStaple(der []byte, leaf *x509.Certificate, issuer *x509.Certificate) (*ocspSingleResponse, error) {
+	var resp ocspResponse
+	if rest, err := asn1.Unmarshal(der, &resp); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, fmt.Errorf("trailing data after response")
+	}
+	if resp.Status != 0 {
+		return nil, fmt.Errorf("responder status %d", resp.Status)
+	}
+	if !resp.Response.ResponseType.Equal(oidOCSPBasic) {
+		return nil, fmt.Errorf("unsupported response type %v", resp.Response.ResponseType)
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return nil, err
+	}
+	algo, ok := ocspSignatureAlgorithms[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signature algorithm %v", basic.SignatureAlgorithm.Algorithm)
+	}
+	// the issuer sign itself or delegate to a responder certificate it signed
+	signer := issuer
+	if len(basic.Certificates) > 0 {
+		cert, err := x509.ParseCertificate(basic.Certificates[0].FullBytes)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(cert.Raw, issuer.Raw) {
+			if err := cert.CheckSignatureFrom(issuer); err != nil {
+				return nil, fmt.Errorf("responder not signed by issuer: %v", err)
+			}
+			delegated := false
+			for _, usage := range cert.ExtKeyUsage {
+				if usage == x509.ExtKeyUsageOCSPSigning {
+					delegated = true
+				}
+			}
+			if !delegated {
+				return nil, fmt.Errorf("responder %s not allowed to sign ocsp", cert.Subject)
+			}
+			signer = cert
+		}
+	}
+	if err := signer.CheckSignature(algo, basic.TBSResponseData.Raw, basic.Signature.RightAlign()); err != nil {
+		return nil, fmt.Errorf("bad signature: %v", err)
+	}
+	for i := range basic.TBSResponseData.Responses {
+		single := &basic.TBSResponseData.Responses[i]
+		if single.CertID.SerialNumber == nil || single.CertID.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+			continue
+		}
+		// the same serial from another CA is not about leaf
+		if err := checkCertIDIssuer(single.CertID, issuer); err != nil {
+			return nil, err
+		}
+		return single, nil
+	}
+	return nil, fmt.Errorf("no response for serial %v", leaf.SerialNumber)
+}
+
+// checkCertIDIssuer check the name and key hash of id are the ones of issuer
+func checkCertIDIssuer(id ocspCertID, issuer *x509.Certificate) error {
+	hash, ok := ocspHashAlgorithms[id.HashAlgorithm.Algorithm.String()]
+	if !ok || !hash.Available() {
+		return fmt.Errorf("unsupported cert id hash %v", id.HashAlgorithm.Algorithm)
+	}
+	// the key hash cover the subjectPublicKey bits only, not the whole SubjectPublicKeyInfo
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return err
+	}
+	h := hash.New()
+	h.Write(issuer.RawSubject)
+	if !bytes.Equal(h.Sum(nil), id.NameHash) {
+		return fmt.Errorf("cert id name hash is not %s", issuer.Subject)
+	}
+	h = hash.New()
+	h.Write(spki.PublicKey.RightAlign())
+	if !bytes.Equal(h.Sum(nil), id.IssuerKeyHash) {
+		return fmt.Errorf("cert id key hash is not the key of %s", issuer.Subject)
+	}
+	return nil
+}
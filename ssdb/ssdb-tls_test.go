@@ -0,0 +1,250 @@
+package ssdb
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t testing.TB, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// issue sign a server certificate for 127.0.0.1
+func (ca *testCA) issue(t testing.TB, serial int64) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// staple build an ocsp response for leaf, the CertID name and key hash are the ones of
+// idIssuer and signer sign it with ecdsa-with-SHA256, status set the good or revoked flag
+func staple(t testing.TB, leaf *x509.Certificate, idIssuer *x509.Certificate, signer crypto.Signer, status func(*ocspSingleResponse)) []byte {
+	t.Helper()
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(idIssuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		t.Fatal(err)
+	}
+	nameHash := sha1.Sum(idIssuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+	keyID, err := asn1.Marshal(keyHash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	single := ocspSingleResponse{
+		CertID: ocspCertID{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}, Parameters: asn1.NullRawValue},
+			NameHash:      nameHash[:],
+			IssuerKeyHash: keyHash[:],
+			SerialNumber:  leaf.SerialNumber,
+		},
+		ThisUpdate: now.Add(-time.Minute),
+		NextUpdate: now.Add(time.Hour),
+	}
+	status(&single)
+	data := ocspResponseData{
+		RawResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: keyID},
+		ProducedAt:     now,
+		Responses:      []ocspSingleResponse{single},
+	}
+	tbs, err := asn1.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(tbs)
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.Raw = tbs
+	basic, err := asn1.Marshal(ocspBasicResponse{
+		TBSResponseData:    data,
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+		Signature:          asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(ocspResponse{Response: ocspResponseBytes{ResponseType: oidOCSPBasic, Response: basic}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func good(s *ocspSingleResponse) {
+	s.Good = true
+}
+
+func TestVerifyOCSPStaple(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	other := newTestCA(t, "other ca")
+	leaf := ca.issue(t, 42).Leaf
+	chain := [][]*x509.Certificate{{leaf, ca.cert}}
+	cases := []struct {
+		name   string
+		staple []byte
+		want   error
+	}{
+		{"good", staple(t, leaf, ca.cert, ca.key, good), nil},
+		{"revoked", staple(t, leaf, ca.cert, ca.key, func(s *ocspSingleResponse) {
+			s.Revoked = ocspRevokedInfo{RevocationTime: time.Now().UTC().Add(-time.Hour).Truncate(time.Second)}
+		}), ErrCertRevoked},
+		{"expired", staple(t, leaf, ca.cert, ca.key, func(s *ocspSingleResponse) {
+			s.Good = true
+			s.ThisUpdate = s.ThisUpdate.Add(-2 * time.Hour)
+			s.NextUpdate = s.ThisUpdate.Add(time.Hour)
+		}), ErrOCSPStaple},
+		{"wrong signer", staple(t, leaf, ca.cert, other.key, good), ErrOCSPStaple},
+		{"other issuer", staple(t, leaf, other.cert, ca.key, good), ErrOCSPStaple},
+		{"missing", nil, ErrOCSPStaple},
+	}
+	for _, tc := range cases {
+		err := verifyOCSPStaple(tls.ConnectionState{VerifiedChains: chain, OCSPResponse: tc.staple})
+		if tc.want == nil && err != nil || tc.want != nil && !errors.Is(err, tc.want) {
+			t.Errorf("%s staple: %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+// tlsServer serve the script replies over tls with cert
+func tlsServer(t testing.TB, cert tls.Certificate) (string, int) {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveScript(t, ln, func(req []string) []string {
+		return []string{"ok", "1"}
+	})
+	return splitAddr(t, ln.Addr().String())
+}
+
+func TestConnectRequireOCSPStaple(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	stapled := ca.issue(t, 7)
+	stapled.OCSPStaple = staple(t, stapled.Leaf, ca.cert, ca.key, good)
+	host, port := tlsServer(t, stapled)
+	c, err := Connect(host, port, "", true, ca.pem(), WithRequireOCSPStaple(true))
+	if err != nil {
+		t.Fatalf("connect with a good staple: %v", err)
+	}
+	c.Close()
+
+	revoked := ca.issue(t, 8)
+	revoked.OCSPStaple = staple(t, revoked.Leaf, ca.cert, ca.key, func(s *ocspSingleResponse) {
+		s.Revoked = ocspRevokedInfo{RevocationTime: time.Now().UTC().Truncate(time.Second)}
+	})
+	host, port = tlsServer(t, revoked)
+	c, err = Connect(host, port, "", true, ca.pem(), WithRequireOCSPStaple(true))
+	if c != nil {
+		// a failed Connect still return the client retrying in background
+		c.Close()
+	}
+	if !errors.Is(err, ErrCertRevoked) {
+		t.Fatalf("connect with a revoked staple = %v, want ErrCertRevoked", err)
+	}
+}
+
+func TestConnectPinnedCert(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	cert := ca.issue(t, 9)
+	host, port := tlsServer(t, cert)
+	sum := sha256.Sum256(cert.Leaf.Raw)
+	// openssl style, upper case with ':' separators
+	var parts []string
+	for _, b := range sum {
+		parts = append(parts, fmt.Sprintf("%02X", b))
+	}
+	cases := []struct {
+		name string
+		pin  string
+		want error
+	}{
+		{"match", strings.Join(parts, ":"), nil},
+		{"match plain hex", hex.EncodeToString(sum[:]), nil},
+		{"mismatch", strings.Repeat("ab", sha256.Size), ErrCertPinMismatch},
+		{"malformed", "not-a-fingerprint", ErrBadArgument},
+		{"short", "abcd", ErrBadArgument},
+	}
+	for _, tc := range cases {
+		c, err := Connect(host, port, "", true, ca.pem(), WithPinnedCert(tc.pin))
+		if c != nil {
+			c.Close()
+		}
+		if tc.want == nil && err != nil || tc.want != nil && !errors.Is(err, tc.want) {
+			t.Errorf("%s pin: %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
@@ -29,6 +29,7 @@ type UnixClient struct {
 	Connected bool
 	Retry bool
 	mu	*sync.Mutex
+	debug bool
 }
 
 var unixVersion string = "0.1.2"
@@ -58,6 +59,14 @@ func Unixconnect(ip string, port int,auth string) (*UnixClient, error) {
 	return &c, err
 }
 
+func (c *UnixClient) Debug(flag bool) bool {
+	c.debug = flag
+	if c.debug {
+		log.Println("SSDB UnixClient Debug Mode:", c.debug)
+	}
+	return c.debug
+}
+
 func (c *UnixClient) Connect() error {
 	types := "unix" // or "unixgram" or "unixpacket"
 	//laddr := net.UnixAddr{"/tmp/ssdbcli", types}
@@ -69,7 +78,7 @@ func (c *UnixClient) Connect() error {
 	c.sock = sock
 	c.Connected = true
 	if c.Retry {
-		if debug {
+		if c.debug {
 			log.Printf("Client[%s] Retry connect to %s:%d success.",c.Id, c.Ip, c.Port)
 		}	
 	}
@@ -91,7 +100,7 @@ func (c *UnixClient) RetryConnect() {
 	}
 	c.mu.Unlock()
 	if Retry {
-		if debug {
+		if c.debug {
 			log.Printf("Client[%s] Retry connect to %s:%d",c.Id, c.Ip, c.Port)
 		}	
 		time.Sleep(2 * time.Second)
@@ -121,7 +130,7 @@ func (c *UnixClient) Do(args ...interface{}) ([]string, error) {
 	if c.Connected {
 	     err := c.send(args)
 	     if err != nil {
-	     	 if debug {
+	     	 if c.debug {
 	         	log.Printf("SSDB Client[%s] Do Send Error:%v Data:%v\n",c.Id,err,args)
 	         }	
 	         c.CheckError(err)
@@ -129,7 +138,7 @@ func (c *UnixClient) Do(args ...interface{}) ([]string, error) {
 	     }
 	     resp, err := c.recv()
 	     if err != nil {
-	     	  if debug {
+	     	  if c.debug {
 	          	log.Printf("SSDB Client[%s] Do Receive Error:%v Data:%v\n",c.Id,err,args)
 	          }	
 	          c.CheckError(err)
@@ -2,16 +2,17 @@ package ssdb
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	_ "io"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	"math/rand"
 	"net"
 	"reflect"
 	"strconv"
@@ -19,74 +20,482 @@ import (
 	"sync"
 	_ "syscall"
 	"time"
-	"unsafe"
 )
 
 type Client struct {
-	sock       net.Conn
-	recv_buf   bytes.Buffer
-	process    chan []interface{}
-	batchBuf   [][]interface{}
-	result     chan ClientResult
-	Id         string
-	Ip         string
-	Port       int
-	Password   string
-	Connected  bool
-	Retry      bool
-	mu         *sync.Mutex
-	Closed     bool
-	init       bool
-	zip        bool
-	cmdTimeout int
-	tlsInfo    ClientTlsInfo //use TLS for server varification
+	sock         net.Conn
+	recv_buf     bytes.Buffer
+	process      chan []interface{}
+	batchBuf     [][]interface{}
+	Id           string
+	Ip           string
+	Port         int
+	Password     string
+	Connected    bool
+	Retry        bool
+	mu           *sync.Mutex
+	Closed       bool
+	init         bool
+	zip          bool
+	cmdTimeout   time.Duration
+	tlsInfo      ClientTlsInfo  //use TLS for server varification
+	inflight     sync.WaitGroup // commands waiting on processDo
+	processDone  chan struct{}  // closed when processDo exits
+	quit         chan struct{}  // closed by Close, stop processDo and the callers waiting to queue
+	hashPageSize int            // page size of HashKeysAll/HashGetAllLite
+	hashChunked  int            // HashGetAll page through hashes bigger than this, 0 is off
+	backoffMin   time.Duration  // first reconnect delay
+	backoffMax   time.Duration  // reconnect delay cap
+	maxAttempts  int            // reconnect attempts before give up, 0 is unlimited
+	termErr      error          // set when the client stop recovering
+	state        ClientState
+	onState      func(old ClientState, new ClientState)
+	seq          uint64                       // last runId
+	pending      map[string]chan ClientResult // reply channel by runId
+	observer     Observer
+	logger       Logger
+	debug        bool
+	opMu         sync.Mutex    // serialize the read-modify-write helpers
+	network      string        // "unix" dial the socket path in Ip, tcp otherwise
+	stopHealth   chan struct{} // closed by Close to stop the health check
+	compressor   Compressor    // codec of the zip mode, gzip if nil
+	batchConns   int           // max connections of BatchSend, 0 use defaultBatchConns
+	writeBuffer  int           // bytes gathered by sendAll before a write, 0 write each command
+	slowLog      time.Duration // log commands slower than this, 0 is off
+	tracer       Tracer
+	dialTimeout  time.Duration                                                     // timeout of dial and tls handshake
+	maxResponse  int                                                               // bytes a response may take, 0 is unlimited
+	dialFunc     func(ctx context.Context, network, addr string) (net.Conn, error) // custom transport, nil use net.Dialer
+	lazy         bool                                                              // not dialed yet, the first command connect
+	lazyMu       sync.Mutex                                                        // guard lazy and the first dial
+	tcpKeepAlive time.Duration                                                     // tcp keepalive period, 0 keep the Go default and <0 disable it
+	lastResponse int                                                               // bytes of the last response, guarded by mu
+	largeWarn    int                                                               // log responses bigger than this, 0 is off
+}
+
+// Logger receive the diagnostics of the client, *log.Logger satisfy it
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+// WithLogger route the client logs to l, a logger that drop everything silence the client
+func WithLogger(l Logger) Option {
+	return func(c *Client) {
+		c.logger = l
+	}
+}
+
+func (c *Client) logf(format string, args ...interface{}) {
+	if c.logger == nil {
+		log.Printf(format, args...)
+		return
+	}
+	c.logger.Printf(format, args...)
+}
+
+func (c *Client) logln(args ...interface{}) {
+	c.logf("%s", fmt.Sprintln(args...))
+}
+
+// Observer receive the name, duration and error of every command run by Do or ProcessCmd
+type Observer interface {
+	ObserveCommand(cmd string, dur time.Duration, err error)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) ObserveCommand(cmd string, dur time.Duration, err error) {}
+
+// WithObserver set the observer of command metrics
+func WithObserver(o Observer) Option {
+	return func(c *Client) {
+		c.observer = o
+	}
+}
+
+// WithSlowThreshold log every Do or ProcessCmd command that take longer than d
+func WithSlowThreshold(d time.Duration) Option {
+	return func(c *Client) {
+		c.slowLog = d
+	}
+}
+
+// Tracer is called before a command is queued, the returned function is called with the
+// command error once the response is back. It let a span wrap each command without
+// tying the client to a tracing library.
+type Tracer func(ctx context.Context, cmd string) (context.Context, func(err error))
+
+func nopTracer(ctx context.Context, cmd string) (context.Context, func(err error)) {
+	return ctx, func(err error) {}
+}
+
+// WithTracer set the tracer invoked around DoContext and ProcessCmdContext
+func WithTracer(t Tracer) Option {
+	return func(c *Client) {
+		c.tracer = t
+	}
+}
+
+func (c *Client) trace(ctx context.Context, cmd string) (context.Context, func(err error)) {
+	if c == nil || c.tracer == nil {
+		return nopTracer(ctx, cmd)
+	}
+	return c.tracer(ctx, cmd)
+}
+
+type ClientState int
+
+const (
+	StateDisconnected ClientState = iota
+	StateConnected
+	StateReconnecting
+	StateClosed
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "disconnected"
+}
+
+// Option configure the client before it connect
+type Option func(*Client)
+
+// WithReconnectBackoff set the exponential backoff of RetryConnect,
+// maxAttempts 0 retry forever
+func WithReconnectBackoff(min time.Duration, max time.Duration, maxAttempts int) Option {
+	return func(c *Client) {
+		c.backoffMin = min
+		c.backoffMax = max
+		c.maxAttempts = maxAttempts
+	}
+}
+
+// WithClientCert set the client certificate and key PEM presented on tls connection
+func WithClientCert(cert []byte, key []byte) Option {
+	return func(c *Client) {
+		c.tlsInfo.clientCrt = cert
+		c.tlsInfo.clientKey = key
+	}
+}
+
+// WithDebug enable debug logs of the client from the first connect
+func WithDebug(flag bool) Option {
+	return func(c *Client) {
+		c.debug = flag
+	}
+}
+
+// WithHashPageSize set the page size used by HashKeysAll and HashGetAllLite
+func WithHashPageSize(size int) Option {
+	return func(c *Client) {
+		c.hashPageSize = size
+	}
+}
+
+// WithBatchConns bound the number of connections BatchSend open at once,
+// the chunks are drained by that many workers
+func WithBatchConns(n int) Option {
+	return func(c *Client) {
+		c.batchConns = n
+	}
+}
+
+const defaultBatchConns = 8
+
+// WithWriteBuffer let MultiMode and Pipeline gather the encoded commands
+// and write them once every size bytes instead of once per command
+func WithWriteBuffer(size int) Option {
+	return func(c *Client) {
+		c.writeBuffer = size
+	}
+}
+
+// WithDialTimeout bound the dial and tls handshake of Connect and reconnect, default 60s
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.dialTimeout = d
+	}
+}
+
+// WithDialer replace the dial of the connection, e.g. to go through a SOCKS proxy or a tunnel.
+// The ctx carry the connect timeout, (*net.Dialer).DialContext fit as is.
+// In TLS mode the handshake run on top of the returned connection.
+func WithDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return func(c *Client) {
+		c.dialFunc = dial
+	}
+}
+
+// WithTCPKeepAlive set the keepalive period of the tcp socket, also under tls,
+// so a peer gone without FIN is detected by the kernel instead of by a command timeout.
+// A negative period turn keepalive off, 0 keep the Go default.
+func WithTCPKeepAlive(period time.Duration) Option {
+	return func(c *Client) {
+		c.tcpKeepAlive = period
+	}
+}
+
+// WithMaxResponseSize bound the size of one response, a bigger value or buffer fail the
+// command with ErrResponseTooLarge instead of growing the memory, 0 remove the bound
+func WithMaxResponseSize(bytes int) Option {
+	return func(c *Client) {
+		c.maxResponse = bytes
+	}
+}
+
+const defaultMaxResponse = 256 << 20
+
+// WithLargeResponseWarn log the command of every response bigger than bytes,
+// to find the hash and scan calls pulling huge payloads, 0 is off
+func WithLargeResponseWarn(bytes int) Option {
+	return func(c *Client) {
+		c.largeWarn = bytes
+	}
+}
+
+// WithHashGetAllChunked make HashGetAll page through a hash with more than threshold fields
+// like HashGetAllLite, instead of reading it with a single hgetall
+func WithHashGetAllChunked(threshold int) Option {
+	return func(c *Client) {
+		c.hashChunked = threshold
+	}
 }
 
 // TLS info
 type ClientTlsInfo struct {
-	enable bool
-	caCrt  []byte
-	conn   *tls.Conn
+	enable    bool
+	caCrt     []byte
+	clientCrt []byte // client certificate PEM for mutual TLS
+	clientKey []byte
+	pinned    string // sha256 fingerprint of the server leaf certificate, see WithPinnedCert
+	ocsp      bool   // require a good stapled ocsp response, see WithRequireOCSPStaple
+	conn      *tls.Conn
 }
 
 type ClientResult struct {
 	Id    string
 	Data  []string
+	Raw   [][]byte // set instead of Data for a command queued with rawReply
 	Error error
 }
 
 type ClientProcessResult struct {
 	Data  []string
+	Raw   [][]byte
 	Error error
 }
 
+// rawReply follow the runId of a queued command to read its response as bytes
+type rawReply struct{}
+
 type HashData struct {
 	HashName string
 	Key      string
 	Value    string
+	Found    bool // set by HashMultiGetOrdered
 }
 
-var debug bool = false
 var version string = "0.1.8"
 
+// ClientVersion return the version of this package
+func ClientVersion() string {
+	return version
+}
+
+// ErrReconnectFailed is returned after RetryConnect used up its attempts
+var ErrReconnectFailed = errors.New("ssdb: reconnect attempts exhausted")
+
+// ErrBadArgument is returned by Send for an argument type it can not encode
+var ErrBadArgument = errors.New("ssdb: bad argument")
+
+// ErrNotFound is returned when the server responds with not_found,
+// check it with errors.Is(err, ssdb.ErrNotFound)
+var ErrNotFound = errors.New("ssdb: not found")
+
+// ErrServerError, ErrClientError and ErrServerFail match the error, client_error and fail
+// status of a response, the wrapping error carry the message of the server
+var (
+	ErrServerError = errors.New("ssdb: server error")
+	ErrClientError = errors.New("ssdb: client error")
+	ErrServerFail  = errors.New("ssdb: server fail")
+)
+
+// ErrConnClosed is returned when the connection was closed by the server or by Close,
+// rather than broken by a network error
+var ErrConnClosed = errors.New("ssdb: connection closed")
+
+// ErrResponseTooLarge is returned when a response go over the WithMaxResponseSize limit
+var ErrResponseTooLarge = errors.New("ssdb: response too large")
+
+// ErrLockNotHeld is returned by Unlock when the lock expired or belong to another token
+var ErrLockNotHeld = errors.New("ssdb: lock not held")
+
+// ErrAuthFailed is returned by Connect when the server reject the password
+var ErrAuthFailed = errors.New("ssdb: auth failed")
+
+// ErrTimeout is returned when a command run over its timeout,
+// check it with errors.Is(err, ssdb.ErrTimeout)
+var ErrTimeout = errors.New("ssdb: command timeout")
+
+// ErrCertPinMismatch is returned by Connect when the server certificate does not match WithPinnedCert
+var ErrCertPinMismatch = errors.New("ssdb: tls certificate pin mismatch")
+
+// ErrOCSPStaple is returned by Connect when WithRequireOCSPStaple is set and the server
+// staple is missing, badly signed, stale or not good for its certificate
+var ErrOCSPStaple = errors.New("ssdb: tls ocsp staple invalid")
+
+// ErrCertRevoked is returned by Connect when the stapled ocsp response revoke the server certificate
+var ErrCertRevoked = errors.New("ssdb: tls certificate revoked")
+
 const layout = "2006-01-06 15:04:05"
 
-func Connect(host string, port int, auth string, tlsMode bool, caCrt []byte) (*Client, error) {
-    client, err := connect(host, port, auth, tlsMode, caCrt)
-    if err != nil {
-        if debug {
-            log.Printf("SSDB Client Connect failed:%s:%d error:%v\n", host, port, err)
-        }
-        go client.RetryConnect()
-        return client, err
-    }
-    if client != nil {
-        return client, nil
-    }
-    return nil, nil
+// Status is the response code, the first line of every response
+type Status int
+
+const (
+	StatusOK Status = iota
+	StatusNotFound
+	StatusError
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusNotFound:
+		return "not_found"
+	}
+	return "error"
+}
+
+// ParseStatus classify a raw response like the one returned by Do,
+// it return the status, the data lines after the status and the error of a non-ok status
+func ParseStatus(resp []string) (Status, []string, error) {
+	if len(resp) == 0 {
+		return StatusError, nil, fmt.Errorf("bad response:%v", resp)
+	}
+	switch resp[0] {
+	case "ok":
+		return StatusOK, resp[1:], nil
+	case "not_found":
+		return StatusNotFound, resp[1:], fmt.Errorf("%w: %v", ErrNotFound, resp[0])
+	case "error":
+		return StatusError, resp[1:], fmt.Errorf("%w: %s", ErrServerError, strings.Join(resp[1:], " "))
+	case "client_error":
+		return StatusError, resp[1:], fmt.Errorf("%w: %s", ErrClientError, strings.Join(resp[1:], " "))
+	case "fail":
+		return StatusError, resp[1:], fmt.Errorf("%w: %s", ErrServerFail, strings.Join(resp[1:], " "))
+	}
+	return StatusError, resp[1:], fmt.Errorf("bad response:%v", resp)
 }
 
-func connect(ip string, port int, auth string, tlsMode bool, caCrt []byte) (*Client, error) {
+// Connect dial the server, on error see ConnectContext for when a client is still returned
+func Connect(host string, port int, auth string, tlsMode bool, caCrt []byte, opts ...Option) (*Client, error) {
+	return ConnectContext(context.Background(), host, port, auth, tlsMode, caCrt, opts...)
+}
+
+// ConnectContext is Connect with a context, cancel it abort the dial and tls handshake.
+// The client is nil when ctx is done (ctx.Err() is returned), the password is refused
+// (ErrAuthFailed) or the host does not resolve. Any other error, like a refused dial or
+// a failed tls check, return the client with RetryConnect running in background next to
+// the error, Close it to stop the retry.
+func ConnectContext(ctx context.Context, host string, port int, auth string, tlsMode bool, caCrt []byte, opts ...Option) (*Client, error) {
+	client, err := connect(ctx, host, port, auth, tlsMode, caCrt, opts...)
+	if err != nil {
+		if client.debug {
+			client.logf("SSDB Client Connect failed:%s:%d error:%v\n", host, port, err)
+		}
+		if ctx.Err() != nil {
+			client.Close()
+			return nil, ctx.Err()
+		}
+		// a wrong password will not recover by retrying either
+		if errors.Is(err, ErrAuthFailed) {
+			client.Close()
+			return nil, err
+		}
+		// a host that can not be resolved will not recover by retrying
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			client.Close()
+			return nil, fmt.Errorf("ssdb: cannot resolve host %q: %w", host, err)
+		}
+		go client.RetryConnect()
+		return client, err
+	}
+	return client, nil
+}
+
+// ConnectUnix connect to the unix domain socket at path, the path is kept in Ip
+// so RetryConnect redial the same socket
+func ConnectUnix(path string, auth string, opts ...Option) (*Client, error) {
+	opts = append([]Option{func(c *Client) {
+		c.network = "unix"
+	}}, opts...)
+	return Connect(path, 0, auth, false, nil, opts...)
+}
+
+// ConnectTLSFromFiles load PEM files and connect with tls, empty path is skipped,
+// without client cert and key it is server-auth-only tls
+func ConnectTLSFromFiles(host string, port int, auth string, caCertPath string, clientCertPath string, clientKeyPath string, opts ...Option) (*Client, error) {
+	var caCrt, clientCrt, clientKey []byte
+	var err error
+	if caCertPath != "" {
+		caCrt, err = ioutil.ReadFile(caCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("ssdb: load ca cert %q: %w", caCertPath, err)
+		}
+	}
+	if clientCertPath != "" {
+		clientCrt, err = ioutil.ReadFile(clientCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("ssdb: load client cert %q: %w", clientCertPath, err)
+		}
+	}
+	if clientKeyPath != "" {
+		clientKey, err = ioutil.ReadFile(clientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("ssdb: load client key %q: %w", clientKeyPath, err)
+		}
+	}
+	if (clientCrt == nil) != (clientKey == nil) {
+		return nil, fmt.Errorf("ssdb: client cert and client key must be set together")
+	}
+	if clientCrt != nil {
+		opts = append([]Option{WithClientCert(clientCrt, clientKey)}, opts...)
+	}
+	return Connect(host, port, auth, true, caCrt, opts...)
+}
+
+func connect(ctx context.Context, ip string, port int, auth string, tlsMode bool, caCrt []byte, opts ...Option) (*Client, error) {
+    c := newClient(ip, port, auth, tlsMode, caCrt, opts...)
+    err := c.connectContext(ctx)
+    return c, err
+}
+
+// NewLazy return a configured client that is not connected yet, the first command dial the server.
+// It spread the handshakes of an application creating many clients at startup.
+func NewLazy(host string, port int, auth string, tlsMode bool, caCrt []byte, opts ...Option) *Client {
+	c := newClient(host, port, auth, tlsMode, caCrt, opts...)
+	c.lazy = true
+	return c
+}
+
+// newClient set the defaults and apply opts, it does not dial
+func newClient(ip string, port int, auth string, tlsMode bool, caCrt []byte, opts ...Option) *Client {
     //log.Printf("SSDB Client Version:%s\n", version)
     var c Client
     c.Ip = ip
@@ -96,31 +505,135 @@ func connect(ip string, port int, auth string, tlsMode bool, caCrt []byte) (*Cli
     c.mu = &sync.Mutex{}
     c.tlsInfo.enable = tlsMode
     c.tlsInfo.caCrt = caCrt
-    c.cmdTimeout = 25000 // default 25 sec, prevent ssdb connection handle time over 30 sec
-    err := c.Connect()
-    return &c, err
+    c.cmdTimeout = 25 * time.Second // default 25 sec, prevent ssdb connection handle time over 30 sec
+    c.dialTimeout = 60 * time.Second
+    c.maxResponse = defaultMaxResponse
+    c.backoffMin = 100 * time.Millisecond
+    c.backoffMax = 30 * time.Second
+    c.observer = nopObserver{}
+    c.logger = stdLogger{}
+    c.stopHealth = make(chan struct{})
+    for _, opt := range opts {
+        opt(&c)
+    }
+    return &c
+}
+
+// lazyConnect dial a client made by NewLazy on its first command, a failed dial
+// is returned to that command and the next command try again
+func (c *Client) lazyConnect(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	c.lazyMu.Lock()
+	defer c.lazyMu.Unlock()
+	if !c.lazy || c.Closed {
+		return nil
+	}
+	if err := c.connectContext(ctx); err != nil {
+		return err
+	}
+	c.lazy = false
+	return nil
+}
+
+// Clone open a new connection to the same server with all the settings of c
+func (c *Client) Clone() (*Client, error) {
+	return Connect(c.Ip, c.Port, c.Password, c.tlsInfo.enable, c.tlsInfo.caCrt, c.inherit)
+}
+
+// inherit copy the settings of c to a new client, used as an Option by Clone
+func (c *Client) inherit(n *Client) {
+	n.zip = c.zip
+	n.cmdTimeout = c.cmdTimeout
+	n.tlsInfo.clientCrt = c.tlsInfo.clientCrt
+	n.tlsInfo.clientKey = c.tlsInfo.clientKey
+	n.tlsInfo.pinned = c.tlsInfo.pinned
+	n.tlsInfo.ocsp = c.tlsInfo.ocsp
+	n.hashPageSize = c.hashPageSize
+	n.hashChunked = c.hashChunked
+	n.dialTimeout = c.dialTimeout
+	n.maxResponse = c.maxResponse
+	n.dialFunc = c.dialFunc
+	n.tcpKeepAlive = c.tcpKeepAlive
+	n.largeWarn = c.largeWarn
+	n.backoffMin = c.backoffMin
+	n.backoffMax = c.backoffMax
+	n.maxAttempts = c.maxAttempts
+	n.observer = c.observer
+	n.logger = c.logger
+	n.debug = c.debug
+	n.network = c.network
+	n.compressor = c.compressor
+	n.batchConns = c.batchConns
+	n.writeBuffer = c.writeBuffer
+	n.slowLog = c.slowLog
+	n.tracer = c.tracer
 }
 
 func (c *Client) Debug(flag bool) bool {
-	debug = flag
-	if debug {
-		log.Println("SSDB Client Debug Mode:", debug)
+	c.debug = flag
+	if c.debug {
+		c.logln("SSDB Client Debug Mode:", c.debug)
+	}
+	return c.debug
+}
+
+// OnStateChange register a callback called when the client connect, start reconnecting or close
+func (c *Client) OnStateChange(fn func(old ClientState, new ClientState)) {
+	c.mu.Lock()
+	c.onState = fn
+	c.mu.Unlock()
+}
+
+func (c *Client) setState(state ClientState) {
+	c.mu.Lock()
+	old := c.state
+	c.state = state
+	fn := c.onState
+	c.mu.Unlock()
+	if fn != nil && old != state {
+		fn(old, state)
 	}
-	return debug
 }
 
+// UseZip compress the commands sent by this client,
+// the inner connections of BatchSend and MultiHashSet are made by Clone and inherit it
 func (c *Client) UseZip(flag bool) {
 	c.zip = flag
 	//log.Println("SSDB Client Zip Mode:", c.zip)
 }
+// Deprecated: SetCmdTimeout take milliseconds, use SetCommandTimeout.
 func (c *Client) SetCmdTimeout(cmdTimeout int) {
-	c.cmdTimeout = cmdTimeout
-	//log.Printf("set cmd timeout to %d",c.cmdTimeout)
+	c.SetCommandTimeout(time.Duration(cmdTimeout) * time.Millisecond)
+}
+
+// SetCommandTimeout set how long a command may wait for its response, zero wait forever
+func (c *Client) SetCommandTimeout(d time.Duration) {
+	c.cmdTimeout = d
+	//log.Printf("set cmd timeout to %v",c.cmdTimeout)
+}
+
+// addr return host:port, IPv6 literals are bracketed like [::1]:8888
+func (c *Client) addr() string {
+	return net.JoinHostPort(c.Ip, strconv.Itoa(c.Port))
 }
+
 func (c *Client) Connect() error {
-	seconds := 60
-	timeOut := time.Duration(seconds) * time.Second
+	return c.connectContext(context.Background())
+}
+
+func (c *Client) connectContext(parent context.Context) error {
+	timeOut := c.dialTimeout
+	if timeOut <= 0 {
+		timeOut = 60 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(parent, timeOut)
+	defer cancel()
 
+	// the new socket is swapped in under mu, processDo may still be failing on the old one
+	var tlsSock *tls.Conn
+	var plainSock net.Conn
 	// [GDNS-3721] support tls connection
 	if c.tlsInfo.enable {
 		tlsDialer := new(net.Dialer)
@@ -128,113 +641,363 @@ func (c *Client) Connect() error {
 		// default append linux root CAs from /etc/ssl/certs
 		pool, err := x509.SystemCertPool()
 		if err != nil {
-			log.Println("Get linux root CAs certs failed:", err)
+			c.logln("Get linux root CAs certs failed:", err)
 		}
 		if c.tlsInfo.caCrt != nil && len(c.tlsInfo.caCrt) > 0 {
 			//log.Printf("c.tlsInfo.caCrt: %v", string(c.tlsInfo.caCrt))
 			ok := pool.AppendCertsFromPEM(c.tlsInfo.caCrt)
 			if !ok {
-				log.Println("SSDB Client append certs failed:", c.tlsInfo.caCrt)
+				c.logln("SSDB Client append certs failed:", c.tlsInfo.caCrt)
 			}
 		}
 		conf := &tls.Config{
 			//InsecureSkipVerify: true,
 			RootCAs: pool,
 		}
-		conn, err := tls.DialWithDialer(tlsDialer, "tcp", fmt.Sprintf("%s:%d", c.Ip, c.Port), conf)
+		if len(c.tlsInfo.clientCrt) > 0 {
+			cert, err := tls.X509KeyPair(c.tlsInfo.clientCrt, c.tlsInfo.clientKey)
+			if err != nil {
+				c.logln("SSDB Client load client cert failed:", err, c.Id)
+				return err
+			}
+			conf.Certificates = []tls.Certificate{cert}
+		}
+		if err := c.tlsInfo.harden(conf); err != nil {
+			c.logln("SSDB Client tls config invalid:", err, c.Id)
+			return err
+		}
+		if c.dialFunc != nil {
+			rawConn, err := c.dialFunc(ctx, "tcp", c.addr())
+			if err != nil {
+				c.logln("SSDB Client tls-dial failed:", err, c.Id)
+				return err
+			}
+			conf.ServerName = c.Ip
+			conn := tls.Client(rawConn, conf)
+			if err := conn.HandshakeContext(ctx); err != nil {
+				rawConn.Close()
+				c.logln("SSDB Client tls-handshake failed:", err, c.Id)
+				return err
+			}
+			tlsSock = conn
+		} else {
+			tlsDial := &tls.Dialer{NetDialer: tlsDialer, Config: conf}
+			tlsConn, err := tlsDial.DialContext(ctx, "tcp", c.addr())
+			if err != nil {
+				c.logln("SSDB Client tls-dial failed:", err, c.Id)
+				return err
+			}
+			if conn, ok := tlsConn.(*tls.Conn); ok {
+				tlsSock = conn
+			}
+		}
+	} else if c.dialFunc != nil {
+		network, addr := "tcp", c.addr()
+		if c.network == "unix" {
+			network, addr = "unix", c.Ip
+		}
+		sock, err := c.dialFunc(ctx, network, addr)
 		if err != nil {
-			log.Println("SSDB Client tls-dial failed:", err, c.Id)
+			c.logln("SSDB Client dial failed:", err, c.Id)
 			return err
 		}
-		if conn != nil {
-			c.tlsInfo.conn = conn
+		plainSock = sock
+	} else if c.network == "unix" {
+		sock, err := new(net.Dialer).DialContext(ctx, "unix", c.Ip)
+		if err != nil {
+			c.logln("SSDB Client dial failed:", err, c.Id)
+			return err
 		}
+		plainSock = sock
 	} else {
-		sock, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", c.Ip, c.Port), timeOut)
+		sock, err := c.dialTCP(ctx)
 		if err != nil {
-			log.Println("SSDB Client dial failed:", err, c.Id)
+			c.logln("SSDB Client dial failed:", err, c.Id)
 			return err
 		}
-		c.sock = sock
+		plainSock = sock
 	}
-	c.Connected = true
-	if c.Retry {
-		log.Printf("Client[%s] retry connect to %s:%d success.", c.Id, c.Ip, c.Port)
+	c.mu.Lock()
+	if c.tlsInfo.enable {
+		c.tlsInfo.conn = tlsSock
 	} else {
-		if debug {
-			if c.tlsInfo.enable {
-				log.Printf("Client[%s] connect to %s:%d success. Info:%v\n", c.Id, c.Ip, c.Port, c.tlsInfo.conn.LocalAddr())
-			} else {
-				log.Printf("Client[%s] connect to %s:%d success. Info:%v\n", c.Id, c.Ip, c.Port, c.sock.LocalAddr())
-			}
-		}
+		c.sock = plainSock
 	}
+	c.Connected = true
+	retry := c.Retry
 	c.Retry = false
 	if !c.init {
 		c.process = make(chan []interface{})
-		c.result = make(chan ClientResult)
+		c.pending = make(map[string]chan ClientResult)
+		c.processDone = make(chan struct{})
+		c.quit = make(chan struct{})
 		go c.processDo()
 		c.init = true
 	}
+	c.mu.Unlock()
+	c.setKeepAlive()
+	c.setState(StateConnected)
+	if retry {
+		c.logf("Client[%s] retry connect to %s:%d success.", c.Id, c.Ip, c.Port)
+	} else {
+		if c.debug {
+			c.logf("Client[%s] connect to %s:%d success. Info:%v\n", c.Id, c.Ip, c.Port, c.LocalAddr())
+		}
+	}
 
 	if c.Password != "" {
-		c.Auth(c.Password)
+		ok, err := c.Auth(c.Password)
+		if err == nil && !ok {
+			err = fmt.Errorf("password not accepted")
+		}
+		if err != nil {
+			c.logf("Client[%s] auth to %s:%d failed. Error:%v\n", c.Id, c.Ip, c.Port, err)
+			c.mu.Lock()
+			c.Connected = false
+			c.mu.Unlock()
+			if conn := c.conn(); conn != nil {
+				conn.Close()
+			}
+			c.setState(StateDisconnected)
+			return fmt.Errorf("%w: %v", ErrAuthFailed, err)
+		}
 	}
 
 	return nil
 }
 
+// minDialShare is the least time an address get from partialDeadline, like the net package
+const minDialShare = 2 * time.Second
+
+// partialDeadline split the time left until deadline evenly between the remaining addresses,
+// a share never go under minDialShare unless the deadline itself is closer
+func partialDeadline(now time.Time, deadline time.Time, remaining int) time.Time {
+	left := deadline.Sub(now)
+	share := left / time.Duration(remaining)
+	if share < minDialShare {
+		share = minDialShare
+	}
+	if share >= left {
+		return deadline
+	}
+	return now.Add(share)
+}
+
+// dialTCP resolve the host and try each address in order until one connect,
+// each address get its share of the deadline and the last dial error is returned when all of them fail
+func (c *Client) dialTCP(ctx context.Context) (net.Conn, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, c.Ip)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{}
+	port := strconv.Itoa(c.Port)
+	var lastErr error
+	for i, addr := range addrs {
+		// a black-holed first address must not eat the time of the next ones
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			actx, cancel = context.WithDeadline(ctx, partialDeadline(time.Now(), deadline, len(addrs)-i))
+		}
+		conn, err := dialer.DialContext(actx, "tcp", net.JoinHostPort(addr.String(), port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if c.debug {
+			c.logf("Client[%s] dial %v failed:%v\n", c.Id, addr, err)
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no address found for %s", c.Ip)
+	}
+	return nil, lastErr
+}
+
+// setKeepAlive apply WithTCPKeepAlive to the tcp connection under the plain or tls socket,
+// a connection from WithDialer which is not tcp is left alone
+func (c *Client) setKeepAlive() {
+	if c.tcpKeepAlive == 0 {
+		return
+	}
+	conn := c.conn()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if c.tcpKeepAlive < 0 {
+		tcpConn.SetKeepAlive(false)
+		return
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		c.logf("Client[%s] set tcp keepalive failed:%v\n", c.Id, err)
+		return
+	}
+	tcpConn.SetKeepAlivePeriod(c.tcpKeepAlive)
+}
+
 func (c *Client) KeepAlive() {
-	go c.HealthCheck()
+	c.KeepAliveEvery(30 * time.Second)
+}
+
+// KeepAliveEvery ping the server every interval until the client is closed
+func (c *Client) KeepAliveEvery(interval time.Duration) {
+	go c.healthCheck(interval)
 }
 
 func (c *Client) HealthCheck() {
-	timeout := 30
+	c.healthCheck(30 * time.Second)
+}
+
+func (c *Client) healthCheck(interval time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	stop := c.stopHealth
+	c.mu.Unlock()
 	for {
-		if c != nil && c.Connected && !c.Retry && !c.Closed {
+		c.mu.Lock()
+		closed, ready := c.Closed, c.Connected && !c.Retry
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+		if ready {
 			result, err := c.Do("ping")
 			if err != nil {
-				log.Printf("Client Health Check Failed[%s]:%v\n", c.Id, err)
+				c.logf("Client Health Check Failed[%s]:%v\n", c.Id, err)
 			} else {
-				if debug {
-					log.Printf("Client Health Check Success[%s]:%v\n", c.Id, result)
+				if c.debug {
+					c.logf("Client Health Check Success[%s]:%v\n", c.Id, result)
 				}
 			}
 		}
-		time.Sleep(time.Duration(timeout) * time.Second)
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Ping send ping and return the round-trip time
+func (c *Client) Ping() (time.Duration, error) {
+	start := time.Now()
+	resp, err := c.Do("ping")
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) == 0 || resp[0] != "ok" {
+		return 0, fmt.Errorf("bad response:%v args:%v", resp, "ping")
 	}
+	return time.Since(start), nil
 }
 
 func (c *Client) RetryConnect() {
-	if !c.Retry {
+	// CheckError can fire from several paths for one broken socket, only one retry loop run
+	c.mu.Lock()
+	if c.Retry {
+		c.mu.Unlock()
+		return
+	}
+	c.Retry = true
+	c.Connected = false
+	c.mu.Unlock()
+	c.setState(StateReconnecting)
+	//log.Printf("Client[%s] retry connect to %s:%d Connected:%v Closed:%v\n", c.Id, c.Ip, c.Port, c.Connected, c.Closed)
+	attempt := 0
+	for {
 		c.mu.Lock()
-		c.Retry = true
-		c.Connected = false
+		connected, closed := c.Connected, c.Closed
 		c.mu.Unlock()
-		//log.Printf("Client[%s] retry connect to %s:%d Connected:%v Closed:%v\n", c.Id, c.Ip, c.Port, c.Connected, c.Closed)
-		for {
-			if !c.Connected && !c.Closed {
-				err := c.Connect()
-				if err != nil {
-					log.Printf("Client[%s] Retry connect to %s:%d Failed. Error:%v\n", c.Id, c.Ip, c.Port, err)
-					time.Sleep(5 * time.Second)
+		if !connected && !closed {
+			err := c.Connect()
+			if err != nil {
+				attempt++
+				// the password will not fix itself, stop instead of hammering the server
+				if errors.Is(err, ErrAuthFailed) {
+					c.logf("Client[%s] Retry connect to %s:%d give up on auth failure. Error:%v\n", c.Id, c.Ip, c.Port, err)
+					c.mu.Lock()
+					c.termErr = err
+					c.Retry = false
+					c.mu.Unlock()
+					c.Close()
+					break
 				}
-			} else {
-				log.Printf("Client[%s] Retry connect to %s:%d stop by conn:%v closed:%v\n.", c.Id, c.Ip, c.Port, c.Connected, c.Closed)
-				break
+				if c.maxAttempts > 0 && attempt >= c.maxAttempts {
+					c.logf("Client[%s] Retry connect to %s:%d give up after %d attempts. Error:%v\n", c.Id, c.Ip, c.Port, attempt, err)
+					c.mu.Lock()
+					c.termErr = fmt.Errorf("%w: %d attempts, last error:%v", ErrReconnectFailed, attempt, err)
+					c.Retry = false
+					c.mu.Unlock()
+					c.Close()
+					break
+				}
+				wait := c.backoff(attempt)
+				c.logf("Client[%s] Retry connect to %s:%d Failed. Retry in %v Error:%v\n", c.Id, c.Ip, c.Port, wait, err)
+				time.Sleep(wait)
 			}
+		} else {
+			c.logf("Client[%s] Retry connect to %s:%d stop by conn:%v closed:%v\n.", c.Id, c.Ip, c.Port, connected, closed)
+			break
+		}
+	}
+}
+
+// backoff return the delay before the next attempt, doubled each attempt with jitter
+func (c *Client) backoff(attempt int) time.Duration {
+	min, max := c.backoffMin, c.backoffMax
+	if min <= 0 {
+		min = 100 * time.Millisecond
+	}
+	if max < min {
+		max = min
+	}
+	d := max
+	if attempt < 32 {
+		d = min << uint(attempt-1)
+		if d <= 0 || d > max {
+			d = max
 		}
 	}
+	// full delay in [d/2, d]
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// IsAlive report whether the client can run commands now: connected, not reconnecting and not closed
+func (c *Client) IsAlive() bool {
+	if c == nil || c.mu == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Connected && !c.Retry && !c.Closed
+}
+
+// Err return the terminal error once the client gave up recovering
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.termErr
 }
 
 func (c *Client) CheckError(err error) {
 	if err != nil {
-		if !c.Closed {
-			log.Printf("Check Error:%v Retry connect.\n", err)
-			if c.tlsInfo.enable {
-				c.tlsInfo.conn.Close()
-			} else {
-				c.sock.Close()
+		c.mu.Lock()
+		closed := c.Closed
+		c.mu.Unlock()
+		if !closed {
+			c.logf("Check Error:%v Retry connect.\n", err)
+			if conn := c.conn(); conn != nil {
+				conn.Close()
 			}
 			go c.RetryConnect()
 		}
@@ -242,36 +1005,123 @@ func (c *Client) CheckError(err error) {
 	}
 }
 
+// processDo run the queued commands one by one until Close close quit,
+// process itself is never closed so a caller queuing during Close can not panic
 func (c *Client) processDo() {
-	for args := range c.process {
-		var timeout uint32 = 0
+	defer close(c.processDone)
+	quit := c.quit
+	for {
+		var args []interface{}
+		select {
+		case <-quit:
+			return
+		case args = <-c.process:
+		}
+		var timeout time.Duration
 		var runArgs []interface{}
 		runId := ""
-		if debug {
-			log.Println("processDo:", args)
+		if c.debug {
+			c.logln("processDo:", args)
 		}
 		switch args[0].(type) {
-		case uint32:
-			timeout = args[0].(uint32)
+		case time.Duration:
+			timeout = args[0].(time.Duration)
 			runId = args[1].(string)
 			runArgs = args[2:]
 		default:
 			// NXG Add for cmd timeout start
-			timeout = uint32(c.cmdTimeout)
+			timeout = c.cmdTimeout
 			// NXG Add for cmd timeout end
 			runId = args[0].(string)
 			runArgs = args[1:]
 		}
-		if debug {
-			log.Println("processDo runArgs:", runArgs, timeout)
+		raw := false
+		var job *pipeJob
+		if len(runArgs) > 0 {
+			switch first := runArgs[0].(type) {
+			case rawReply:
+				raw = true
+				runArgs = runArgs[1:]
+			case *pipeJob:
+				job = first
+			}
 		}
-		result, err := c.do(runArgs, timeout)
-		if !c.isChanClosed(c.result) {
-			c.result <- ClientResult{Id: runId, Data: result, Error: err}
+		if c.debug {
+			c.logln("processDo runArgs:", runArgs, timeout)
 		}
-	}
-}
-
+		var result ClientProcessResult
+		if job != nil {
+			result.Error = c.doPipe(job, timeout)
+		} else {
+			result = c.do(runArgs, timeout, raw)
+		}
+		c.mu.Lock()
+		reply := c.pending[runId]
+		delete(c.pending, runId)
+		c.mu.Unlock()
+		if reply != nil {
+			reply <- ClientResult{Id: runId, Data: result.Data, Raw: result.Raw, Error: result.Error}
+		}
+	}
+}
+
+// enter register an in-flight command, it fails once the client is closing
+func (c *Client) enter() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Closed {
+		return false
+	}
+	c.inflight.Add(1)
+	return true
+}
+
+// newRunId return a unique id to match a command with its result
+func (c *Client) newRunId() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	return strconv.FormatUint(c.seq, 10)
+}
+
+// roundTrip queue args to processDo and wait for the result of runId,
+// each caller get its own reply channel so concurrent callers never see each other results
+// a ctx done before the result drop the reply, processDo still run the command if it was queued
+func (c *Client) roundTrip(ctx context.Context, runId string, args []interface{}) ClientResult {
+	reply := make(chan ClientResult, 1)
+	c.mu.Lock()
+	c.pending[runId] = reply
+	c.mu.Unlock()
+	select {
+	case c.process <- args:
+	case <-c.quit:
+		// processDo is gone, nothing was sent
+		c.mu.Lock()
+		delete(c.pending, runId)
+		c.mu.Unlock()
+		return ClientResult{Id: runId, Error: ErrConnClosed}
+	case <-ctx.Done():
+		return c.dropReply(ctx, runId)
+	}
+	select {
+	case result := <-reply:
+		return result
+	case <-ctx.Done():
+		return c.dropReply(ctx, runId)
+	}
+}
+
+func (c *Client) dropReply(ctx context.Context, runId string) ClientResult {
+	c.mu.Lock()
+	delete(c.pending, runId)
+	c.mu.Unlock()
+	err := ctx.Err()
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return ClientResult{Id: runId, Error: err}
+}
+
 func ArrayAppendToFirst(src []interface{}, dst []interface{}) []interface{} {
 	tmp := src
 	tmp = append(tmp, dst...)
@@ -279,40 +1129,162 @@ func ArrayAppendToFirst(src []interface{}, dst []interface{}) []interface{} {
 }
 
 func (c *Client) Do(args ...interface{}) ([]string, error) {
-	if c != nil && c.Connected && !c.Retry && !c.Closed {
-		runId := fmt.Sprintf("%d", time.Now().UnixNano())
+	return c.DoContext(context.Background(), args...)
+}
+
+// DoContext is Do with a context, the wait for the result stop when ctx is done
+func (c *Client) DoContext(ctx context.Context, args ...interface{}) ([]string, error) {
+	cmd := cmdName(args)
+	ctx, end := c.trace(ctx, cmd)
+	start := time.Now()
+	var resp []string
+	err := c.lazyConnect(ctx)
+	if err == nil {
+		resp, err = c.doCmd(ctx, args...)
+	}
+	c.observe(cmd, start, err)
+	end(err)
+	return resp, err
+}
+
+func (c *Client) observe(cmd string, start time.Time, err error) {
+	if c == nil {
+		return
+	}
+	dur := time.Since(start)
+	if c.slowLog > 0 && dur > c.slowLog {
+		c.logf("SSDB Client[%s] slow command:%s took %v Error:%v\n", c.Id, cmd, dur, err)
+	}
+	if c.observer == nil {
+		return
+	}
+	c.observer.ObserveCommand(cmd, dur, err)
+}
+
+// cmdName return the command of Do args, skipping the leading timeout
+func cmdName(args []interface{}) string {
+	args = cmdArgs(args)
+	if len(args) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%v", args[0])
+}
+
+// cmdArgs return args from the command on, a command passed as one slice,
+// like Do([]interface{}{"set", key, val}), is unwrapped so only its name is reported
+func cmdArgs(args []interface{}) []interface{} {
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case int:
+			continue
+		case []interface{}:
+			return cmdArgs(arg)
+		case []string:
+			flat := make([]interface{}, len(arg))
+			for j, v := range arg {
+				flat[j] = v
+			}
+			return flat
+		}
+		return args[i:]
+	}
+	return nil
+}
+
+func (c *Client) doCmd(ctx context.Context, args ...interface{}) ([]string, error) {
+	if c.IsAlive() && c.enter() {
+		defer c.inflight.Done()
+		runId := c.newRunId()
 		switch args[0].(type) {
 		case int:
-			timeout := uint32(args[0].(int))
+			// the leading int of Do is the timeout in ms
+			timeout := time.Duration(args[0].(int)) * time.Millisecond
 			args = args[1:]
 			args = ArrayAppendToFirst([]interface{}{runId}, args)
 			args = ArrayAppendToFirst([]interface{}{timeout}, args)
 		default:
 			args = ArrayAppendToFirst([]interface{}{runId}, args)
 		}
-		if debug {
-			log.Println("Do:", args)
+		if c.debug {
+			c.logln("Do:", args)
 		}
 		defer func() {
 			if r := recover(); r != nil {
 				fmt.Println("Recovered in Do", r)
 			}
 		}()
-		c.process <- args
-		for result := range c.result {
-			if result.Id == runId {
-				return result.Data, result.Error
-			} else {
-				c.result <- result
-			}
+		result := c.roundTrip(ctx, runId, args)
+		return result.Data, result.Error
+	}
+	if c != nil {
+		if err := c.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("Connection has closed.")
+}
+
+// doBytes is doCmd reading the response with recvBytes
+func (c *Client) doBytes(ctx context.Context, args ...interface{}) ([][]byte, error) {
+	if err := c.lazyConnect(ctx); err != nil {
+		return nil, err
+	}
+	if c.IsAlive() && c.enter() {
+		defer c.inflight.Done()
+		runId := c.newRunId()
+		args = ArrayAppendToFirst([]interface{}{runId, rawReply{}}, args)
+		result := c.roundTrip(ctx, runId, args)
+		return result.Raw, result.Error
+	}
+	if c != nil {
+		if err := c.Err(); err != nil {
+			return nil, err
 		}
 	}
 	return nil, fmt.Errorf("Connection has closed.")
 }
 
+// DoRaw send the command and read its response directly on the connection,
+// bypassing processDo. It is for single-threaded admin tooling and not safe for concurrent use.
+func (c *Client) DoRaw(args ...interface{}) ([]string, error) {
+	if !c.IsAlive() {
+		return nil, fmt.Errorf("lost connection")
+	}
+	c.setDeadline(c.cmdTimeout)
+	defer c.setDeadline(0)
+	err := c.Send(args)
+	if err != nil {
+		c.logf("SSDB Client[%s] DoRaw Send Error:%v Data:%v\n", c.Id, err, args)
+		if !errors.Is(err, ErrBadArgument) {
+			c.CheckError(err)
+		}
+		return nil, err
+	}
+	resp, err := c.recv()
+	if err != nil {
+		c.logf("SSDB Client[%s] DoRaw Receive Error:%v Data:%v\n", c.Id, err, args)
+		c.CheckError(err)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// DoStrings run a command whose arguments are all strings
+func (c *Client) DoStrings(cmd string, args ...string) ([]string, error) {
+	params := make([]interface{}, 0, len(args)+1)
+	params = append(params, cmd)
+	for _, arg := range args {
+		params = append(params, arg)
+	}
+	return c.Do(params...)
+}
+
 func (c *Client) BatchAppend(args ...interface{}) {
-	if c != nil && c.Connected && !c.Retry && !c.Closed {
+	// a lazy client connect when Exec run the batch
+	if c.IsAlive() || c != nil && c.lazy && !c.Closed {
+		c.mu.Lock()
 		c.batchBuf = append(c.batchBuf, args)
+		c.mu.Unlock()
 	}
 	defer func() {
 		if r := recover(); r != nil {
@@ -321,40 +1293,89 @@ func (c *Client) BatchAppend(args ...interface{}) {
 	}()
 }
 
-func (c *Client) Exec() ([][]string, error) {
-	if c != nil && c.Connected && !c.Retry && !c.Closed {
-		if len(c.batchBuf) > 0 {
-			runId := fmt.Sprintf("%d", time.Now().UnixNano())
-			firstElement := c.batchBuf[0]
-			jsonStr, err := json.Marshal(&c.batchBuf)
+// BatchReset drop the commands added by BatchAppend without running them
+func (c *Client) BatchReset() {
+	c.mu.Lock()
+	c.batchBuf = nil
+	c.mu.Unlock()
+}
+
+// BatchLen return the number of commands waiting for Exec
+func (c *Client) BatchLen() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.batchBuf)
+}
+
+type BatchResult struct {
+	Data  []string
+	Error error
+}
+
+// Exec run the commands added by BatchAppend with batchexec and return one result per command,
+// an async batch get no responses so every result is empty
+func (c *Client) Exec() ([]BatchResult, error) {
+	// count the same batch that was sent, other goroutines may append meanwhile
+	batch, resp, err := c.execBatch()
+	if err != nil {
+		return nil, err
+	}
+	n := len(batch)
+	async := n > 0 && len(batch[0]) > 0 && batch[0][0] == "async"
+	if async {
+		return make([]BatchResult, n), nil
+	}
+	results := make([]BatchResult, 0, len(resp))
+	for _, r := range resp {
+		result := BatchResult{Data: r}
+		_, _, result.Error = ParseStatus(r)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Deprecated: ExecStrings is the former Exec, use Exec for per-command errors.
+func (c *Client) ExecStrings() ([][]string, error) {
+	_, resp, err := c.execBatch()
+	return resp, err
+}
+
+// execBatch take the commands added by BatchAppend and run them, it return the batch it took
+func (c *Client) execBatch() ([][]interface{}, [][]string, error) {
+	if err := c.lazyConnect(context.Background()); err != nil {
+		return nil, nil, err
+	}
+	if c.IsAlive() && c.enter() {
+		defer c.inflight.Done()
+		// take the whole batch so appends made meanwhile go to the next Exec
+		c.mu.Lock()
+		batch := c.batchBuf
+		c.batchBuf = nil
+		c.mu.Unlock()
+		if len(batch) > 0 {
+			runId := c.newRunId()
+			firstElement := batch[0]
+			jsonStr, err := json.Marshal(&batch)
 			if err != nil {
-				return [][]string{}, fmt.Errorf("Exec Json Error:%v", err)
+				return batch, [][]string{}, fmt.Errorf("Exec Json Error:%v", err)
 			}
 			args := []interface{}{"batchexec", string(jsonStr)}
 			args = ArrayAppendToFirst([]interface{}{runId}, args)
-			c.batchBuf = c.batchBuf[:0]
-			c.process <- args
-			for result := range c.result {
-				if result.Id == runId {
-					if len(result.Data) == 2 && result.Data[0] == "ok" {
-						var resp [][]string
-						if firstElement[0] != "async" {
-							err := json.Unmarshal([]byte(result.Data[1]), &resp)
-							if err != nil {
-								return [][]string{}, fmt.Errorf("Batch Json Error:%v", err)
-							}
-						}
-						return resp, result.Error
-					} else {
-						return [][]string{}, result.Error
+			result := c.roundTrip(context.Background(), runId, args)
+			if len(result.Data) == 2 && result.Data[0] == "ok" {
+				var resp [][]string
+				if len(firstElement) == 0 || firstElement[0] != "async" {
+					err := json.Unmarshal([]byte(result.Data[1]), &resp)
+					if err != nil {
+						return batch, [][]string{}, fmt.Errorf("Batch Json Error:%v", err)
 					}
-
-				} else {
-					c.result <- result
 				}
+				return batch, resp, result.Error
+			} else {
+				return batch, [][]string{}, result.Error
 			}
 		} else {
-			return [][]string{}, fmt.Errorf("Batch Exec Error:No Batch Command found.")
+			return nil, [][]string{}, fmt.Errorf("Batch Exec Error:No Batch Command found.")
 		}
 	}
 	defer func() {
@@ -362,174 +1383,245 @@ func (c *Client) Exec() ([][]string, error) {
 			fmt.Println("Recovered in Exec", r)
 		}
 	}()
-	return nil, fmt.Errorf("Connection has closed.")
-}
-
-func (c *Client) do(args []interface{}, timeout uint32) ([]string, error) {
-	if c.Connected {
-		signal := make(chan ClientProcessResult)
-		if timeout > 0 {
-			if debug {
-				log.Println("Do setTimeout:", timeout)
-			}
-			go c.setTimeout(timeout, signal)
+	return nil, nil, fmt.Errorf("Connection has closed.")
+}
+
+// do run one command on the connection, raw read the response with recvBytes.
+// The timeout is a deadline on the socket covering both the send and the whole response,
+// so the call block on the socket only and return ErrTimeout when the deadline pass.
+func (c *Client) do(args []interface{}, timeout time.Duration, raw bool) ClientProcessResult {
+	c.mu.Lock()
+	connected := c.Connected
+	c.mu.Unlock()
+	if connected {
+		var cpr ClientProcessResult
+		if c.debug && timeout > 0 {
+			c.logln("Do setTimeout:", timeout)
 		}
-
-		go func() {
-			if !c.isChanClosed(signal) {
-				var cpr ClientProcessResult
-				err := c.Send(args)
-				if err != nil {
-					if debug {
-						log.Printf("SSDB Client[%s] Do Send Error:%v Data:%v\n", c.Id, err, args)
-					}
-					c.CheckError(err)
-					cpr.Data = nil
-					cpr.Error = err
-				}
-				resp, err := c.recv()
-				if err != nil {
-					if debug {
-						log.Printf("SSDB Client[%s] Do Receive Error:%v Data:%v\n", c.Id, err, args)
-					}
-					c.CheckError(err)
-					cpr.Data = nil
-					cpr.Error = err
-				}
-				cpr.Data = resp
-				cpr.Error = nil
-				if !c.isChanClosed(signal) {
-					signal <- cpr
-				}
-
+		c.setDeadline(timeout)
+		defer c.setDeadline(0)
+		err := c.Send(args)
+		if err != nil {
+			if c.debug {
+				c.logf("SSDB Client[%s] Do Send Error:%v Data:%v\n", c.Id, err, args)
 			}
-		}()
-		for result := range signal {
-			if debug {
-				log.Println("Do Receive:", result)
+			// a bad argument is refused before any byte is written, the connection is still good
+			if !errors.Is(err, ErrBadArgument) {
+				c.CheckError(err)
 			}
-			close(signal)
-			return result.Data, result.Error
+			cpr.Error = wrapTimeout(err, timeout)
+			return cpr
 		}
+		if raw {
+			cpr.Raw, err = c.recvBytes()
+		} else {
+			cpr.Data, err = c.recv()
+		}
+		if err != nil {
+			if c.debug {
+				c.logf("SSDB Client[%s] Do Receive Error:%v Data:%v\n", c.Id, err, args)
+			}
+			c.CheckError(err)
+			cpr.Data, cpr.Raw = nil, nil
+			cpr.Error = wrapTimeout(err, timeout)
+			return cpr
+		}
+		c.warnLargeResponse(args)
+		if c.debug {
+			c.logln("Do Receive:", cpr)
+		}
+		return cpr
 	}
-	return nil, fmt.Errorf("lost ssdb connection")
+	return ClientProcessResult{Error: fmt.Errorf("lost ssdb connection")}
 }
 
-func (c *Client) isChanClosed(ch interface{}) bool {
-	if reflect.TypeOf(ch).Kind() != reflect.Chan {
-		panic("only channels!")
+// LastResponseBytes return the size on the wire of the last response read by the client
+func (c *Client) LastResponseBytes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastResponse
+}
+
+// warnLargeResponse log the command of the last response when it is over WithLargeResponseWarn
+func (c *Client) warnLargeResponse(args []interface{}) {
+	if c.largeWarn <= 0 {
+		return
+	}
+	size := c.LastResponseBytes()
+	if size <= c.largeWarn {
+		return
+	}
+	// only the command and its first argument, a multi_* command can carry a huge args list
+	var name, first string
+	args = cmdArgs(args)
+	if len(args) > 0 {
+		name = fmt.Sprintf("%v", args[0])
+	}
+	if len(args) > 1 {
+		first = fmt.Sprintf("%v", args[1])
 	}
-	cptr := *(*uintptr)(unsafe.Pointer(
-		unsafe.Pointer(uintptr(unsafe.Pointer(&ch)) + unsafe.Sizeof(uint(0))),
-	))
-	cptr += unsafe.Sizeof(uint(0)) * 2
-	cptr += unsafe.Sizeof(unsafe.Pointer(uintptr(0)))
-	cptr += unsafe.Sizeof(uint16(0))
-	return *(*uint32)(unsafe.Pointer(cptr)) > 0
+	c.logf("SSDB Client[%s] Large Response:%d bytes over %d cmd:%s %s\n", c.Id, size, c.largeWarn, name, first)
 }
 
-func (c *Client) setTimeout(timeout uint32, signal chan ClientProcessResult) {
-	boom := time.After(time.Duration(timeout) * time.Millisecond)
-	for {
-		select {
-		case <-boom:
-			if !c.isChanClosed(signal) {
-				var cpr ClientProcessResult
-				cpr.Data = nil
-				cpr.Error = fmt.Errorf("Operation timeout in %d ms.", timeout)
-				signal <- cpr
-			}
-			return
-		default:
-			time.Sleep(50 * time.Millisecond)
+// wrapTimeout turn the error of a socket deadline into ErrTimeout
+func wrapTimeout(err error, timeout time.Duration) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return fmt.Errorf("%w in %v: %v", ErrTimeout, timeout, err)
+	}
+	return err
+}
+
+// conn return the active connection for plain or tls mode
+func (c *Client) conn() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// [GDNS-3721] support tls connection
+	if c.tlsInfo.enable {
+		if c.tlsInfo.conn != nil {
+			return c.tlsInfo.conn
 		}
+		return nil
+	}
+	return c.sock
+}
+
+// LocalAddr return the local address of the connection, nil when disconnected
+func (c *Client) LocalAddr() net.Addr {
+	c.mu.Lock()
+	connected := c.Connected
+	c.mu.Unlock()
+	conn := c.conn()
+	if conn == nil || !connected {
+		return nil
 	}
+	return conn.LocalAddr()
+}
+
+// RemoteAddr return the server address of the connection, nil when disconnected
+func (c *Client) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	connected := c.Connected
+	c.mu.Unlock()
+	conn := c.conn()
+	if conn == nil || !connected {
+		return nil
+	}
+	return conn.RemoteAddr()
+}
+
+// setDeadline set the read/write deadline of the connection, zero clear the deadline
+func (c *Client) setDeadline(timeout time.Duration) {
+	conn := c.conn()
+	if conn == nil {
+		return
+	}
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	conn.SetWriteDeadline(t)
+	conn.SetReadDeadline(t)
 }
 
 func (c *Client) ProcessCmd(cmd string, args []interface{}) (interface{}, error) {
-	if c.Connected {
+	return c.ProcessCmdContext(context.Background(), cmd, args)
+}
+
+// ProcessCmdContext is ProcessCmd with a context, the wait for the result stop when ctx is done
+func (c *Client) ProcessCmdContext(ctx context.Context, cmd string, args []interface{}) (interface{}, error) {
+	ctx, end := c.trace(ctx, cmd)
+	start := time.Now()
+	var val interface{}
+	err := c.lazyConnect(ctx)
+	if err == nil {
+		val, err = c.processCmd(ctx, cmd, args)
+	}
+	c.observe(cmd, start, err)
+	end(err)
+	return val, err
+}
+
+func (c *Client) processCmd(ctx context.Context, cmd string, args []interface{}) (interface{}, error) {
+	if c.IsAlive() && c.enter() {
+		defer c.inflight.Done()
 		args = ArrayAppendToFirst([]interface{}{cmd}, args)
-		runId := fmt.Sprintf("%d", time.Now().UnixNano())
+		runId := c.newRunId()
 		args = ArrayAppendToFirst([]interface{}{runId}, args)
-		if debug {
-			log.Println("ProcessCmd:", args)
-		}
-		var err error
-		c.process <- args
-		var resResult ClientResult
-		for result := range c.result {
-			if result.Id == runId {
-				resResult = result
-				break
-			} else {
-				c.result <- result
-
-			}
+		if c.debug {
+			c.logln("ProcessCmd:", args)
 		}
 		defer func() {
 			if r := recover(); r != nil {
 				fmt.Println("Recovered in ProcessCmd", r)
 			}
 		}()
+		resResult := c.roundTrip(ctx, runId, args)
 		if resResult.Error != nil {
 			return nil, resResult.Error
 		}
 
 		resp := resResult.Data
-		if len(resp) == 2 && resp[0] == "ok" {
+		status, data, err := ParseStatus(resp)
+		if status == StatusOK && len(data) == 1 {
 			switch cmd {
 			case "set", "del":
 				return true, nil
 			case "expire", "setnx", "auth", "exists", "hexists":
-				if resp[1] == "1" {
+				if data[0] == "1" {
 					return true, nil
 				}
 				return false, nil
-			case "hsize":
-				val, err := strconv.ParseInt(resp[1], 10, 64)
+			case "hsize", "setbit", "getbit", "countbit", "bitcount", "strlen", "dbsize",
+				"zrank", "zrrank", "zcount", "zsum", "qtrim_front", "qtrim_back", "multi_del",
+				"qpush_front", "qpush_back", "qpush":
+				val, err := strconv.ParseInt(data[0], 10, 64)
 				return val, err
 			default:
-				return resp[1], nil
+				return data[0], nil
 			}
 
-		} else if len(resp) == 1 && resp[0] == "not_found" {
-			return nil, fmt.Errorf("%v", resp[0])
-		} else {
-			if len(resp) >= 1 && resp[0] == "ok" {
-				//fmt.Println("Process:",args,resp)
-				switch cmd {
-				case "hgetall", "hscan", "hrscan", "multi_hget", "scan", "rscan":
-					list := make(map[string]string)
-					length := len(resp[1:])
-					data := resp[1:]
-					for i := 0; i < length; i += 2 {
-						list[data[i]] = data[i+1]
-					}
-					return list, nil
-				default:
-					return resp[1:], nil
+		} else if status == StatusNotFound {
+			return nil, err
+		} else if status == StatusOK {
+			//fmt.Println("Process:",args,resp)
+			switch cmd {
+			case "hgetall", "hscan", "hrscan", "multi_hget", "scan", "rscan":
+				list := make(map[string]string)
+				length := len(data)
+				for i := 0; i+1 < length; i += 2 {
+					list[data[i]] = data[i+1]
 				}
+				return list, nil
+			default:
+				return data, nil
 			}
 		}
 		if len(resp) == 2 && strings.Contains(resp[1], "connection") {
 			// [GDNS-3721] support tls connection
-			if c.tlsInfo.enable {
-				c.tlsInfo.conn.Close()
-			} else {
-				c.sock.Close()
+			if conn := c.conn(); conn != nil {
+				conn.Close()
 			}
 			go c.RetryConnect()
 		}
-		log.Printf("SSDB Client Error Response:%v args:%v Error:%v", resp, args, err)
-		return nil, fmt.Errorf("bad response:%v args:%v", resp, args)
+		c.logf("SSDB Client Error Response:%v args:%v Error:%v", resp, args, err)
+		return nil, fmt.Errorf("%w args:%v", err, args)
 	} else {
+		if err := c.Err(); err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("lost connection")
 	}
 }
 
-func (c *Client) Auth(pwd string) (interface{}, error) {
-	return c.Do("auth", pwd)
-	//return c.ProcessCmd("auth",params)
+// Auth send the password, it return true only when the server accept it
+func (c *Client) Auth(pwd string) (bool, error) {
+	params := []interface{}{pwd}
+	val, err := c.ProcessCmd("auth", params)
+	if err != nil {
+		return false, err
+	}
+	ok, _ := val.(bool)
+	return ok, nil
 }
 
 func (c *Client) Set(key string, val string) (interface{}, error) {
@@ -542,6 +1634,83 @@ func (c *Client) Get(key string) (interface{}, error) {
 	return c.ProcessCmd("get", params)
 }
 
+// GetInt get key value and parse it as int64
+func (c *Client) GetInt(key string) (int64, error) {
+	val, err := c.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	num, err := strconv.ParseInt(fmt.Sprintf("%v", val), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("GetInt key:%s value:%v is not an integer:%w", key, val, err)
+	}
+	return num, nil
+}
+
+// GetFloat get key value and parse it as float64
+func (c *Client) GetFloat(key string) (float64, error) {
+	val, err := c.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	num, err := strconv.ParseFloat(fmt.Sprintf("%v", val), 64)
+	if err != nil {
+		return 0, fmt.Errorf("GetFloat key:%s value:%v is not a float:%w", key, val, err)
+	}
+	return num, nil
+}
+
+// GetBytes get key value as []byte
+func (c *Client) GetBytes(key string) ([]byte, error) {
+	val, err := c.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%v", val)), nil
+}
+
+// GetRaw get key value as the exact bytes read from the connection, without a string copy
+func (c *Client) GetRaw(key string) ([]byte, error) {
+	start := time.Now()
+	resp, err := c.doBytes(context.Background(), "get", key)
+	if err == nil {
+		switch {
+		case len(resp) == 2 && string(resp[0]) == "ok":
+			c.observe("get", start, nil)
+			return resp[1], nil
+		case len(resp) > 0 && string(resp[0]) == "not_found":
+			err = fmt.Errorf("%w: %s", ErrNotFound, resp[0])
+		default:
+			err = fmt.Errorf("bad response:%q args:%v", resp, []interface{}{"get", key})
+		}
+	}
+	c.observe("get", start, err)
+	return nil, err
+}
+
+// SetJSON marshal v and store it at key
+func (c *Client) SetJSON(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("SetJSON key:%s Json Error:%w", key, err)
+	}
+	_, err = c.Set(key, string(data))
+	return err
+}
+
+// GetJSON unmarshal the value of key into out, missing key return ErrNotFound
+func (c *Client) GetJSON(key string, out interface{}) error {
+	data, err := c.GetBytes(key)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, out)
+	if err != nil {
+		return fmt.Errorf("GetJSON key:%s Json Error:%w", key, err)
+	}
+	return nil
+}
+
 func (c *Client) Del(key string) (interface{}, error) {
 	params := []interface{}{key}
 	return c.ProcessCmd("del", params)
@@ -552,11 +1721,149 @@ func (c *Client) SetX(key string, val string, ttl int) (interface{}, error) {
 	return c.ProcessCmd("setx", params)
 }
 
+// Scan return the range as a map, which lose the server order, use ScanOrdered to keep it
 func (c *Client) Scan(start string, end string, limit int) (interface{}, error) {
 	params := []interface{}{start, end, limit}
 	return c.ProcessCmd("scan", params)
 }
 
+// KV is one key/value pair of an ordered scan
+type KV struct {
+	Key   string
+	Value string
+}
+
+// ScanOrdered is Scan keeping the server order
+func (c *Client) ScanOrdered(start string, end string, limit int) ([]KV, error) {
+	return c.scanKV("scan", start, end, limit)
+}
+
+// RScanOrdered is RScan keeping the server order
+func (c *Client) RScanOrdered(start string, end string, limit int) ([]KV, error) {
+	return c.scanKV("rscan", start, end, limit)
+}
+
+// scanKV run a scan like command and keep its key/value pairs in response order
+func (c *Client) scanKV(args ...interface{}) ([]KV, error) {
+	resp, err := c.Do(args...)
+	if err != nil {
+		return nil, err
+	}
+	status, data, err := ParseStatus(resp)
+	if status != StatusOK {
+		return nil, fmt.Errorf("%w args:%v", err, args)
+	}
+	if len(data)%2 != 0 {
+		return nil, fmt.Errorf("bad response:%v args:%v", resp, args)
+	}
+	list := make([]KV, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		list = append(list, KV{Key: data[i], Value: data[i+1]})
+	}
+	return list, nil
+}
+
+//scan in reverse order from start to end, the map lose the order, use RScanOrdered to keep it
+func (c *Client) RScan(start string, end string, limit int) (map[string]string, error) {
+	params := []interface{}{start, end, limit}
+	val, err := c.ProcessCmd("rscan", params)
+	if err != nil {
+		return nil, err
+	}
+	return val.(map[string]string), nil
+}
+
+//list keys in range (start, end], no values are transferred
+func (c *Client) Keys(start string, end string, limit int) ([]string, error) {
+	params := []interface{}{start, end, limit}
+	val, err := c.ProcessCmd("keys", params)
+	if err != nil {
+		return nil, err
+	}
+	return respStrings(val), nil
+}
+
+//list keys in reverse order in range (start, end]
+func (c *Client) RKeys(start string, end string, limit int) ([]string, error) {
+	params := []interface{}{start, end, limit}
+	val, err := c.ProcessCmd("rkeys", params)
+	if err != nil {
+		return nil, err
+	}
+	return respStrings(val), nil
+}
+
+// DelPrefix delete every key starting with prefix, batch keys per multi_del, and return the total deleted.
+// It is at-least-once: keys written under prefix during the walk may or may not be deleted,
+// run it again to catch them.
+func (c *Client) DelPrefix(prefix string, batch int) (int64, error) {
+	if prefix == "" {
+		return 0, fmt.Errorf("%w: DelPrefix with empty prefix", ErrBadArgument)
+	}
+	if batch <= 0 {
+		batch = 100
+	}
+	var total int64
+	// keys skip the start itself, so the key equal to prefix is handled first
+	found, err := c.Exists(prefix)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		if _, err = c.Del(prefix); err != nil {
+			return 0, err
+		}
+		total++
+	}
+	start, end := prefix, prefix+"\xff"
+	for {
+		keys, err := c.Keys(start, end, batch)
+		if err != nil {
+			return total, err
+		}
+		if len(keys) == 0 {
+			break
+		}
+		params := make([]interface{}, 0, len(keys))
+		for _, k := range keys {
+			params = append(params, k)
+		}
+		val, err := c.ProcessCmd("multi_del", params)
+		if err != nil {
+			return total, err
+		}
+		if n, ok := val.(int64); ok {
+			total += n
+		}
+		if len(keys) < batch {
+			break
+		}
+		start = keys[len(keys)-1]
+	}
+	return total, nil
+}
+
+// respStrings turn a ProcessCmd list result into []string,
+// a single item list come back as a plain string
+func respStrings(val interface{}) []string {
+	switch v := val.(type) {
+	case []string:
+		return v
+	case string:
+		return []string{v}
+	}
+	return []string{}
+}
+
+// respInt64 take the int64 of a ProcessCmd integer result, any other reply is a bad response
+func respInt64(val interface{}, cmd string, params []interface{}) (int64, error) {
+	n, ok := val.(int64)
+	if !ok {
+		return 0, fmt.Errorf("bad response:%v args:%v", val, ArrayAppendToFirst([]interface{}{cmd}, params))
+	}
+	return n, nil
+}
+
 func (c *Client) Expire(key string, ttl int) (interface{}, error) {
 	params := []interface{}{key, ttl}
 	return c.ProcessCmd("expire", params)
@@ -567,12 +1874,111 @@ func (c *Client) KeyTTL(key string) (interface{}, error) {
 	return c.ProcessCmd("ttl", params)
 }
 
+// TTL return the time to live of key and whether it has one,
+// -1 is no ttl and a missing key(-2 or -1 on a key that not exists) return ErrNotFound
+func (c *Client) TTL(key string) (time.Duration, bool, error) {
+	val, err := c.KeyTTL(key)
+	if err != nil {
+		return 0, false, err
+	}
+	ttl, err := strconv.ParseInt(fmt.Sprintf("%v", val), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("TTL key:%s response:%v is not an integer:%w", key, val, err)
+	}
+	switch {
+	case ttl >= 0:
+		return time.Duration(ttl) * time.Second, true, nil
+	case ttl == -1:
+		exists, err := c.Exists(key)
+		if err != nil {
+			return 0, false, err
+		}
+		if !exists {
+			return 0, false, ErrNotFound
+		}
+		return 0, false, nil
+	}
+	return 0, false, ErrNotFound
+}
+
 //set new key if key exists then ignore this operation
 func (c *Client) SetNew(key string, val string) (interface{}, error) {
 	params := []interface{}{key, val}
 	return c.ProcessCmd("setnx", params)
 }
 
+//set new key with ttl and return whether the key was created,
+//setnx and expire are two commands so the key can live without ttl if expire fail
+func (c *Client) SetXNew(key string, val string, ttl int) (bool, error) {
+	created, err := c.SetNew(key, val)
+	if err != nil {
+		return false, err
+	}
+	if created != true {
+		return false, nil
+	}
+	_, err = c.Expire(key, ttl)
+	if err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// CompareAndSet set key to newVal only when its value equal expected and return whether it was swapped.
+// get and set are two commands, only the read-modify-write helpers of this client wait for each other:
+// a plain Set from any goroutine or another client can write between them, so use it with a single writer.
+func (c *Client) CompareAndSet(key string, expected string, newVal string) (bool, error) {
+	c.opMu.Lock()
+	defer c.opMu.Unlock()
+	val, err := c.Get(key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if fmt.Sprintf("%v", val) != expected {
+		return false, nil
+	}
+	_, err = c.Set(key, newVal)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Lock try to take the lock at key for ttl seconds with setnx and expire, the token is needed to Unlock.
+// It is for coarse-grained locking only: a crash between setnx and expire leave a lock without ttl,
+// and a holder that run longer than ttl lose the lock to another client without notice.
+func (c *Client) Lock(key string, ttl int) (acquired bool, token string, err error) {
+	token = fmt.Sprintf("%s-%d-%d", c.Id, time.Now().UnixNano(), rand.Int63())
+	acquired, err = c.SetXNew(key, token, ttl)
+	if !acquired {
+		return false, "", err
+	}
+	// a failed expire still return the token so the caller can Unlock
+	return true, token, err
+}
+
+// Unlock release the lock at key if it still hold token, get and del are two commands
+// so a lock that expire just between them can be released from its new owner.
+func (c *Client) Unlock(key string, token string) error {
+	c.opMu.Lock()
+	defer c.opMu.Unlock()
+	val, err := c.Get(key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("%w: key:%s", ErrLockNotHeld, key)
+		}
+		return err
+	}
+	if fmt.Sprintf("%v", val) != token {
+		return fmt.Errorf("%w: key:%s", ErrLockNotHeld, key)
+	}
+	_, err = c.Del(key)
+	return err
+}
+
 //
 func (c *Client) GetSet(key string, val string) (interface{}, error) {
 	params := []interface{}{key, val}
@@ -585,9 +1991,109 @@ func (c *Client) Incr(key string, val int) (interface{}, error) {
 	return c.ProcessCmd("incr", params)
 }
 
-func (c *Client) Exists(key string) (interface{}, error) {
+//get size bytes of the value from start, missing key return ErrNotFound
+func (c *Client) Substr(key string, start int, size int) (string, error) {
+	params := []interface{}{key, start, size}
+	val, err := c.ProcessCmd("substr", params)
+	if err != nil {
+		return "", err
+	}
+	return val.(string), nil
+}
+
+func (c *Client) Strlen(key string) (int64, error) {
 	params := []interface{}{key}
-	return c.ProcessCmd("exists", params)
+	val, err := c.ProcessCmd("strlen", params)
+	if err != nil {
+		return 0, err
+	}
+	return respInt64(val, "strlen", params)
+}
+
+//set the bit at offset and return the previous bit
+func (c *Client) SetBit(key string, offset int, bit int) (int, error) {
+	params := []interface{}{key, offset, bit}
+	val, err := c.ProcessCmd("setbit", params)
+	if err != nil {
+		return 0, err
+	}
+	n, err := respInt64(val, "setbit", params)
+	return int(n), err
+}
+
+func (c *Client) GetBit(key string, offset int) (int, error) {
+	params := []interface{}{key, offset}
+	val, err := c.ProcessCmd("getbit", params)
+	if err != nil {
+		return 0, err
+	}
+	n, err := respInt64(val, "getbit", params)
+	return int(n), err
+}
+
+//count the set bits from start byte with size bytes
+func (c *Client) CountBit(key string, start int, size int) (int64, error) {
+	params := []interface{}{key, start, size}
+	val, err := c.ProcessCmd("countbit", params)
+	if err != nil {
+		return 0, err
+	}
+	return respInt64(val, "countbit", params)
+}
+
+//count the set bits between start and end byte, like redis bitcount
+func (c *Client) BitCount(key string, start int, end int) (int64, error) {
+	params := []interface{}{key, start, end}
+	val, err := c.ProcessCmd("bitcount", params)
+	if err != nil {
+		return 0, err
+	}
+	return respInt64(val, "bitcount", params)
+}
+
+// IncrBy add delta to key, a missing key start from initial so it become initial+delta.
+// the key is created with setnx, when another writer created it first incr is used instead.
+func (c *Client) IncrBy(key string, delta int64, initial int64) (int64, error) {
+	created, err := c.SetNew(key, strconv.FormatInt(initial+delta, 10))
+	if err != nil {
+		return 0, err
+	}
+	if created == true {
+		return initial + delta, nil
+	}
+	params := []interface{}{key, delta}
+	res, err := c.ProcessCmd("incr", params)
+	if err != nil {
+		return 0, err
+	}
+	num, err := strconv.ParseInt(fmt.Sprintf("%v", res), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("IncrBy key:%s response:%v is not an integer:%w", key, res, err)
+	}
+	return num, nil
+}
+
+//incr num to exist number value and return the new value
+func (c *Client) IncrN(key string, val int) (int64, error) {
+	res, err := c.Incr(key, val)
+	if err != nil {
+		return 0, err
+	}
+	num, err := strconv.ParseInt(fmt.Sprintf("%v", res), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("IncrN key:%s response:%v is not an integer:%w", key, res, err)
+	}
+	return num, nil
+}
+
+func (c *Client) Exists(key string) (bool, error) {
+	params := []interface{}{key}
+	val, err := c.ProcessCmd("exists", params)
+	if err != nil {
+		return false, err
+	}
+	ok, _ := val.(bool)
+	return ok, nil
 }
 
 func (c *Client) HashSet(hash string, key string, val string) (interface{}, error) {
@@ -595,6 +2101,26 @@ func (c *Client) HashSet(hash string, key string, val string) (interface{}, erro
 	return c.ProcessCmd("hset", params)
 }
 
+// HashSetNew set the key field of hash only when it does not exist and return whether it was created.
+// hexists and hset are two commands, only the read-modify-write helpers of this client wait for each other:
+// a plain HashSet from any goroutine or another client can create the field between them.
+func (c *Client) HashSetNew(hash string, key string, val string) (bool, error) {
+	c.opMu.Lock()
+	defer c.opMu.Unlock()
+	exists, err := c.HashExists(hash, key)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+	_, err = c.HashSet(hash, key, val)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // ------  added by Dixen for multi connections Hashset function
 
 func conHelper(chunk []HashData, wg *sync.WaitGroup, c *Client, results []interface{}, errs []error) {
@@ -612,10 +2138,21 @@ func conHelper(chunk []HashData, wg *sync.WaitGroup, c *Client, results []interf
 	fmt.Printf("so - %v\n", time.Now())
 }
 
+// tlsMode and caCrt are kept for compatibility, the inner connections use the settings of c
 func (c *Client) MultiHashSet(parts []HashData, connNum int, tlsMode bool, caCrt []byte) (interface{}, error) {
 	var privatePool []*Client
 	for i := 0; i < connNum-1; i++ {
-		innerClient, _ := Connect(c.Ip, c.Port, c.Password, tlsMode, caCrt)
+		innerClient, err := c.Clone()
+		if err != nil {
+			// a failed clone still retry in background, close it with the ones opened
+			if innerClient != nil {
+				innerClient.Close()
+			}
+			for _, opened := range privatePool {
+				opened.Close()
+			}
+			return nil, err
+		}
 		privatePool = append(privatePool, innerClient)
 	}
 	privatePool = append(privatePool, c)
@@ -645,48 +2182,244 @@ func (c *Client) MultiHashSet(parts []HashData, connNum int, tlsMode bool, caCrt
 }
 
 func (c *Client) MultiMode(args [][]interface{}) ([]string, error) {
-	if c.Connected {
-		for _, v := range args {
-			err := c.Send(v)
-			if err != nil {
-				log.Printf("SSDB Client[%s] Do Send Error:%v Data:%v\n", c.Id, err, args)
-				c.CheckError(err)
-				return nil, err
-			}
+	if c.IsAlive() {
+		err := c.sendAll(args)
+		if err != nil {
+			c.logf("SSDB Client[%s] Do Send Error:%v Data:%v\n", c.Id, err, args)
+			c.CheckError(err)
+			return nil, err
 		}
 		var resps []string
 		for i := 0; i < len(args); i++ {
 			resp, err := c.recv()
 			if err != nil {
-				log.Printf("SSDB Client[%s] Do Receive Error:%v Data:%v\n", c.Id, err, args)
+				c.logf("SSDB Client[%s] Do Receive Error:%v Data:%v\n", c.Id, err, args)
 				c.CheckError(err)
 				return nil, err
 			}
-			resps = append(resps, strings.Join(resp, ","))
+			resps = append(resps, strings.Join(resp, ","))
+		}
+		return resps, nil
+	}
+	return nil, fmt.Errorf("lost connection")
+}
+
+func (c *Client) HashGet(hash string, key string) (interface{}, error) {
+	params := []interface{}{hash, key}
+	return c.ProcessCmd("hget", params)
+}
+
+// HashSetJSON marshal v and store it at the key field of hash
+func (c *Client) HashSetJSON(hash string, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("HashSetJSON hash:%s key:%s Json Error:%w", hash, key, err)
+	}
+	_, err = c.HashSet(hash, key, string(data))
+	return err
+}
+
+// HashGetJSON unmarshal the key field of hash into out, missing field return ErrNotFound
+func (c *Client) HashGetJSON(hash string, key string, out interface{}) error {
+	val, err := c.HashGet(hash, key)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal([]byte(fmt.Sprintf("%v", val)), out)
+	if err != nil {
+		return fmt.Errorf("HashGetJSON hash:%s key:%s Json Error:%w", hash, key, err)
+	}
+	return nil
+}
+
+func (c *Client) HashDel(hash string, key string) (interface{}, error) {
+	params := []interface{}{hash, key}
+	return c.ProcessCmd("hdel", params)
+}
+
+func (c *Client) HashIncr(hash string, key string, val int) (interface{}, error) {
+	params := []interface{}{hash, key, val}
+	return c.ProcessCmd("hincr", params)
+}
+
+func (c *Client) HashIncrN(hash string, key string, val int) (int64, error) {
+	res, err := c.HashIncr(hash, key, val)
+	if err != nil {
+		return 0, err
+	}
+	num, err := strconv.ParseInt(fmt.Sprintf("%v", res), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("HashIncrN hash:%s key:%s response:%v is not an integer:%w", hash, key, res, err)
+	}
+	return num, nil
+}
+
+// HashIncrBy add delta to the key field of hash, a negative delta decrement it.
+// The server reject a field that is not an integer or would overflow int64, that come back as error.
+func (c *Client) HashIncrBy(hash string, key string, delta int64) (int64, error) {
+	params := []interface{}{hash, key, delta}
+	res, err := c.ProcessCmd("hincr", params)
+	if err != nil {
+		return 0, fmt.Errorf("HashIncrBy hash:%s key:%s delta:%d:%w", hash, key, delta, err)
+	}
+	num, err := strconv.ParseInt(fmt.Sprintf("%v", res), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("HashIncrBy hash:%s key:%s response:%v is not an integer:%w", hash, key, res, err)
+	}
+	return num, nil
+}
+
+// hashTTLSuffix name the companion hash keeping the expire time of HashSetTTL fields
+const hashTTLSuffix = "\x01ttl"
+
+// HashSetTTL set a hash field which expire after ttl seconds.
+// SSDB has no ttl on hash fields, this is a client-side emulation: the expire time is kept
+// in a companion hash and checked by HashGetTTL, expired fields stay stored until read.
+func (c *Client) HashSetTTL(hash string, key string, val string, ttl int) error {
+	_, err := c.HashSet(hash, key, val)
+	if err != nil {
+		return err
+	}
+	expireAt := time.Now().Add(time.Duration(ttl) * time.Second).Unix()
+	_, err = c.HashSet(hash+hashTTLSuffix, key, strconv.FormatInt(expireAt, 10))
+	return err
+}
+
+// HashGetTTL get a field set by HashSetTTL, an expired field is deleted and return ErrNotFound
+func (c *Client) HashGetTTL(hash string, key string) (string, error) {
+	expire, err := c.HashGet(hash+hashTTLSuffix, key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", err
+	}
+	if err == nil {
+		expireAt, _ := strconv.ParseInt(fmt.Sprintf("%v", expire), 10, 64)
+		if time.Now().Unix() >= expireAt {
+			c.HashDel(hash, key)
+			c.HashDel(hash+hashTTLSuffix, key)
+			return "", ErrNotFound
+		}
+	}
+	val, err := c.HashGet(hash, key)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v", val), nil
+}
+
+// hashExpiryIndex name the zset indexing the fields set by HashSetWithExpiry,
+// a member is hash+"\x00"+key and its score the unix time the field expire at
+const hashExpiryIndex = "\x01hash_expiry"
+
+// hashExpirySweepBatch is the number of due entries read by one zscan of the sweeper
+const hashExpirySweepBatch = 100
+
+// HashSetWithExpiry set a hash field which is deleted by the sweeper after ttl seconds.
+// Unlike HashSetTTL the field is really removed once due, see ExpireSweep.
+func (c *Client) HashSetWithExpiry(hash string, key string, val string, ttl int) error {
+	_, err := c.HashSet(hash, key, val)
+	if err != nil {
+		return err
+	}
+	expireAt := time.Now().Add(time.Duration(ttl) * time.Second).Unix()
+	params := []interface{}{hashExpiryIndex, hash + "\x00" + key, expireAt}
+	_, err = c.ProcessCmd("zset", params)
+	if err != nil {
+		return fmt.Errorf("HashSetWithExpiry hash:%s key:%s:%w", hash, key, err)
+	}
+	return nil
+}
+
+// SweepExpired run one pass of the sweeper: hdel every field of HashSetWithExpiry
+// which is due and drop it from the index, it return the number of fields removed
+func (c *Client) SweepExpired() (int, error) {
+	removed := 0
+	now := time.Now().Unix()
+	for {
+		params := []interface{}{hashExpiryIndex, "", "", now, hashExpirySweepBatch}
+		val, err := c.ProcessCmd("zscan", params)
+		if err != nil {
+			return removed, err
+		}
+		data := respStrings(val)
+		for i := 0; i+1 < len(data); i += 2 {
+			member := data[i]
+			if idx := strings.IndexByte(member, 0); idx >= 0 {
+				if _, err := c.HashDel(member[:idx], member[idx+1:]); err != nil {
+					return removed, err
+				}
+				removed++
+			}
+			if _, err := c.ProcessCmd("zdel", []interface{}{hashExpiryIndex, member}); err != nil {
+				return removed, err
+			}
+		}
+		if len(data)/2 < hashExpirySweepBatch {
+			return removed, nil
 		}
-		return resps, nil
 	}
-	return nil, fmt.Errorf("lost connection")
 }
 
-func (c *Client) HashGet(hash string, key string) (interface{}, error) {
-	params := []interface{}{hash, key}
-	return c.ProcessCmd("hget", params)
+// ExpireSweep start a goroutine calling SweepExpired every interval,
+// it run until the returned stop is called or the client is closed.
+func (c *Client) ExpireSweep(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	c.mu.Lock()
+	closed := c.stopHealth
+	c.mu.Unlock()
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-closed:
+				return
+			case <-time.After(interval):
+			}
+			if !c.IsAlive() {
+				continue
+			}
+			n, err := c.SweepExpired()
+			if err != nil {
+				c.logf("SSDB Client[%s] Expire Sweep Error:%v\n", c.Id, err)
+			} else if n > 0 && c.debug {
+				c.logf("SSDB Client[%s] Expire Sweep removed %d fields\n", c.Id, n)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
 }
 
-func (c *Client) HashDel(hash string, key string) (interface{}, error) {
+func (c *Client) HashExists(hash string, key string) (bool, error) {
 	params := []interface{}{hash, key}
-	return c.ProcessCmd("hdel", params)
-}
-
-func (c *Client) HashIncr(hash string, key string, val int) (interface{}, error) {
-	params := []interface{}{hash, key, val}
-	return c.ProcessCmd("hincr", params)
+	val, err := c.ProcessCmd("hexists", params)
+	if err != nil {
+		return false, err
+	}
+	ok, _ := val.(bool)
+	return ok, nil
 }
 
-func (c *Client) HashExists(hash string, key string) (interface{}, error) {
-	params := []interface{}{hash, key}
-	return c.ProcessCmd("hexists", params)
+// HashMultiExists check many fields of a hash with pipelined hexists
+func (c *Client) HashMultiExists(hash string, keys []string) (map[string]bool, error) {
+	pipe := c.Pipeline()
+	for _, k := range keys {
+		pipe.HashExists(hash, k)
+	}
+	results, err := pipe.Exec()
+	if err != nil {
+		return nil, err
+	}
+	list := make(map[string]bool)
+	for i, r := range results {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		list[keys[i]] = len(r.Data) == 2 && r.Data[1] == "1"
+	}
+	return list, nil
 }
 
 func (c *Client) HashSize(hash string) (interface{}, error) {
@@ -694,6 +2427,34 @@ func (c *Client) HashSize(hash string) (interface{}, error) {
 	return c.ProcessCmd("hsize", params)
 }
 
+// HashMultiSize return the field count of many hashes with pipelined hsize, a missing hash count 0.
+// The pipeline run as one command so the command timeout bound all the hsize together
+func (c *Client) HashMultiSize(hashes []string) (map[string]int64, error) {
+	pipe := c.Pipeline()
+	for _, h := range hashes {
+		pipe.HashSize(h)
+	}
+	results, err := pipe.Exec()
+	if err != nil {
+		return nil, err
+	}
+	list := make(map[string]int64)
+	for i, r := range results {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		if len(r.Data) != 2 {
+			return nil, fmt.Errorf("bad response:%v args:%v", r.Data, []interface{}{"hsize", hashes[i]})
+		}
+		size, err := strconv.ParseInt(r.Data[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("HashMultiSize hash:%s size:%s is not an integer:%w", hashes[i], r.Data[1], err)
+		}
+		list[hashes[i]] = size
+	}
+	return list, nil
+}
+
 //search from start to end hashmap name or haskmap key name,except start word
 func (c *Client) HashList(start string, end string, limit int) (interface{}, error) {
 	params := []interface{}{start, end, limit}
@@ -709,11 +2470,14 @@ func (c *Client) HashKeysAll(hash string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("DB Hash Size:%d\n", size)
+	c.logf("DB Hash Size:%d\n", size)
 	hashSize := size.(int64)
 	page_range := 15
+	if c.hashPageSize > 0 {
+		page_range = c.hashPageSize
+	}
 	splitSize := math.Ceil(float64(hashSize) / float64(page_range))
-	log.Printf("DB Hash Size:%d hashSize:%d splitSize:%f\n", size, hashSize, splitSize)
+	c.logf("DB Hash Size:%d hashSize:%d splitSize:%f\n", size, hashSize, splitSize)
 	var range_keys []string
 	for i := 1; i <= int(splitSize); i++ {
 		start := ""
@@ -725,7 +2489,7 @@ func (c *Client) HashKeysAll(hash string) ([]string, error) {
 
 		val, err := c.HashKeys(hash, start, end, page_range)
 		if err != nil {
-			log.Println("HashGetAll Error:", err)
+			c.logln("HashGetAll Error:", err)
 			continue
 		}
 		if val == nil {
@@ -742,13 +2506,25 @@ func (c *Client) HashKeysAll(hash string) ([]string, error) {
 		if len(data) > 0 {
 			range_keys = append(range_keys, data...)
 		}
-
+		// last page, stop before the cursor can repeat
+		if len(data) < page_range {
+			break
+		}
 	}
-	log.Printf("DB Hash Keys Size:%d\n", len(range_keys))
+	c.logf("DB Hash Keys Size:%d\n", len(range_keys))
 	return range_keys, nil
 }
 
 func (c *Client) HashGetAll(hash string) (map[string]string, error) {
+	if c.hashChunked > 0 {
+		size, err := c.HashSize(hash)
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := size.(int64); ok && n > int64(c.hashChunked) {
+			return c.HashGetAllLite(hash)
+		}
+	}
 	params := []interface{}{hash}
 	val, err := c.ProcessCmd("hgetall", params)
 	if err != nil {
@@ -756,7 +2532,7 @@ func (c *Client) HashGetAll(hash string) (map[string]string, error) {
 	} else {
 		return val.(map[string]string), err
 	}
-	return nil, fmt.Errorf("Data has empty.")
+	return nil, ErrNotFound
 }
 
 func (c *Client) HashGetAllLite(hash string) (map[string]string, error) {
@@ -767,6 +2543,9 @@ func (c *Client) HashGetAllLite(hash string) (map[string]string, error) {
 	//log.Printf("DB Hash Size:%d\n",size)
 	hashSize := size.(int64)
 	page_range := 20
+	if c.hashPageSize > 0 {
+		page_range = c.hashPageSize
+	}
 	splitSize := math.Ceil(float64(hashSize) / float64(page_range))
 	//log.Printf("DB Hash Size:%d hashSize:%d splitSize:%f\n",size,hashSize,splitSize)
 	var range_keys []string
@@ -781,7 +2560,7 @@ func (c *Client) HashGetAllLite(hash string) (map[string]string, error) {
 
 		val, err := c.HashKeys(hash, start, end, page_range)
 		if err != nil {
-			log.Println("HashGetAll Error:", err)
+			c.logln("HashGetAll Error:", err)
 			continue
 		}
 		if val == nil {
@@ -798,7 +2577,7 @@ func (c *Client) HashGetAllLite(hash string) (map[string]string, error) {
 		if len(data) > 0 {
 			result, err := c.HashMultiGet(hash, data)
 			if err != nil {
-				log.Println("HashGetAll Error:", err)
+				c.logln("HashGetAll Error:", err)
 			}
 			if result == nil {
 				continue
@@ -807,12 +2586,57 @@ func (c *Client) HashGetAllLite(hash string) (map[string]string, error) {
 				GetResult[k] = v
 			}
 		}
-
+		// last page, stop before the cursor can repeat
+		if len(data) < page_range {
+			break
+		}
 	}
 
 	return GetResult, nil
 }
 
+// HashGetAllContext fetch a hash page by page like HashGetAllLite and check ctx between pages,
+// a canceled ctx abort the fetch with ctx.Err(). Unlike HashGetAllLite a failed page is an error.
+func (c *Client) HashGetAllContext(ctx context.Context, hash string) (map[string]string, error) {
+	pageSize := 20
+	if c.hashPageSize > 0 {
+		pageSize = c.hashPageSize
+	}
+	result := make(map[string]string)
+	start := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("HashGetAllContext hash:%s aborted after %d fields:%w", hash, len(result), err)
+		}
+		val, err := c.ProcessCmdContext(ctx, "hkeys", []interface{}{hash, start, "", pageSize})
+		if err != nil {
+			return nil, err
+		}
+		keys := respStrings(val)
+		if len(keys) == 0 {
+			return result, nil
+		}
+		params := []interface{}{hash}
+		for _, k := range keys {
+			params = append(params, k)
+		}
+		val, err = c.ProcessCmdContext(ctx, "multi_hget", params)
+		if err != nil {
+			return nil, err
+		}
+		if page, ok := val.(map[string]string); ok {
+			for k, v := range page {
+				result[k] = v
+			}
+		}
+		if len(keys) < pageSize {
+			return result, nil
+		}
+		start = keys[len(keys)-1]
+	}
+}
+
+// HashScan return the fields as a map, which lose the server order, use HashScanOrdered to keep it
 func (c *Client) HashScan(hash string, start string, end string, limit int) (map[string]string, error) {
 	params := []interface{}{hash, start, end, limit}
 	val, err := c.ProcessCmd("hscan", params)
@@ -825,6 +2649,12 @@ func (c *Client) HashScan(hash string, start string, end string, limit int) (map
 	return nil, nil
 }
 
+// HashScanOrdered is HashScan keeping the server order
+func (c *Client) HashScanOrdered(hash string, start string, end string, limit int) ([]KV, error) {
+	return c.scanKV("hscan", hash, start, end, limit)
+}
+
+// HashRScan return the fields as a map, which lose the server order, use HashRScanOrdered to keep it
 func (c *Client) HashRScan(hash string, start string, end string, limit int) (map[string]string, error) {
 	params := []interface{}{hash, start, end, limit}
 	val, err := c.ProcessCmd("hrscan", params)
@@ -836,157 +2666,596 @@ func (c *Client) HashRScan(hash string, start string, end string, limit int) (ma
 	return nil, nil
 }
 
-func (c *Client) HashMultiSet(hash string, data map[string]string) (interface{}, error) {
-	params := []interface{}{hash}
-	for k, v := range data {
-		params = append(params, k)
-		params = append(params, v)
+// HashRScanOrdered is HashRScan keeping the server order
+func (c *Client) HashRScanOrdered(hash string, start string, end string, limit int) ([]KV, error) {
+	return c.scanKV("hrscan", hash, start, end, limit)
+}
+
+func (c *Client) HashMultiSet(hash string, data map[string]string) (interface{}, error) {
+	params := []interface{}{hash}
+	for k, v := range data {
+		params = append(params, k)
+		params = append(params, v)
+	}
+	return c.ProcessCmd("multi_hset", params)
+}
+
+func (c *Client) HashMultiGet(hash string, keys []string) (map[string]string, error) {
+	params := []interface{}{hash}
+	for _, v := range keys {
+		params = append(params, v)
+	}
+	val, err := c.ProcessCmd("multi_hget", params)
+	if err != nil {
+		return nil, err
+	} else {
+		return val.(map[string]string), err
+	}
+	return nil, ErrNotFound
+}
+
+// HashMultiGetOrdered return the fields in the order of keys with a found flag for each,
+// the bool is true when every key was found
+func (c *Client) HashMultiGetOrdered(hash string, keys []string) ([]HashData, bool, error) {
+	list, err := c.HashMultiGet(hash, keys)
+	if err != nil {
+		return nil, false, err
+	}
+	all := true
+	result := make([]HashData, 0, len(keys))
+	for _, k := range keys {
+		v, ok := list[k]
+		if !ok {
+			all = false
+		}
+		result = append(result, HashData{HashName: hash, Key: k, Value: v, Found: ok})
+	}
+	return result, all, nil
+}
+
+func (c *Client) HashMultiDel(hash string, keys []string) (interface{}, error) {
+	params := []interface{}{hash}
+	for _, v := range keys {
+		params = append(params, v)
+	}
+	return c.ProcessCmd("multi_hdel", params)
+}
+
+func (c *Client) HashClear(hash string) (interface{}, error) {
+	params := []interface{}{hash}
+	return c.ProcessCmd("hclear", params)
+}
+
+// HashClearPrefix clear every hash whose name start with prefix, the names are listed
+// batch at a time with hlist and cleared in one pipeline per batch. It return how many
+// non-empty hashes were cleared, each pipeline run as one command under the command timeout.
+func (c *Client) HashClearPrefix(prefix string, batch int) (int64, error) {
+	if prefix == "" {
+		return 0, fmt.Errorf("%w: HashClearPrefix with empty prefix", ErrBadArgument)
+	}
+	if batch <= 0 {
+		batch = 100
+	}
+	var total int64
+	start, end := prefix, prefix+"\xff"
+	// hlist skip the start itself, so the hash named prefix go with the first batch
+	names := []string{prefix}
+	for {
+		val, err := c.HashList(start, end, batch)
+		if err != nil {
+			return total, err
+		}
+		list := respStrings(val)
+		names = append(names, list...)
+		if len(names) > 0 {
+			p := c.Pipeline()
+			for _, name := range names {
+				p.Do("hclear", name)
+			}
+			results, err := p.Exec()
+			if err != nil {
+				return total, err
+			}
+			for _, r := range results {
+				if r.Error != nil {
+					return total, r.Error
+				}
+				// hclear answer the number of removed fields, 0 when the hash did not exist
+				if len(r.Data) > 1 && r.Data[1] != "0" {
+					total++
+				}
+			}
+		}
+		if len(list) < batch {
+			break
+		}
+		start = list[len(list)-1]
+		names = names[:0]
+	}
+	return total, nil
+}
+
+func (c *Client) ZMultiSet(name string, scores map[string]int64) (interface{}, error) {
+	params := []interface{}{name}
+	for k, v := range scores {
+		params = append(params, k)
+		params = append(params, v)
+	}
+	return c.ProcessCmd("multi_zset", params)
+}
+
+//get scores of keys, missing keys are skipped
+func (c *Client) ZMultiGet(name string, keys []string) (map[string]int64, error) {
+	params := []interface{}{name}
+	for _, v := range keys {
+		params = append(params, v)
+	}
+	val, err := c.ProcessCmd("multi_zget", params)
+	if err != nil {
+		return nil, err
+	}
+	data := respStrings(val)
+	list := make(map[string]int64)
+	for i := 0; i+1 < len(data); i += 2 {
+		score, err := strconv.ParseInt(data[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("ZMultiGet key:%s score:%s is not an integer:%w", data[i], data[i+1], err)
+		}
+		list[data[i]] = score
+	}
+	return list, nil
+}
+
+// ZMember is one member of a zset with its score
+type ZMember struct {
+	Key   string
+	Score int64
+}
+
+// ZPopFront remove and return up to limit members with the lowest scores, an empty zset return an empty slice
+func (c *Client) ZPopFront(name string, limit int) ([]ZMember, error) {
+	return c.zpop("zpop_front", name, limit)
+}
+
+// ZPopBack remove and return up to limit members with the highest scores
+func (c *Client) ZPopBack(name string, limit int) ([]ZMember, error) {
+	return c.zpop("zpop_back", name, limit)
+}
+
+func (c *Client) zpop(cmd string, name string, limit int) ([]ZMember, error) {
+	params := []interface{}{name, limit}
+	val, err := c.ProcessCmd(cmd, params)
+	if err != nil {
+		return nil, err
+	}
+	data := respStrings(val)
+	list := make([]ZMember, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		score, err := strconv.ParseInt(data[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s key:%s score:%s is not an integer:%w", cmd, data[i], data[i+1], err)
+		}
+		list = append(list, ZMember{Key: data[i], Score: score})
+	}
+	return list, nil
+}
+
+func (c *Client) ZMultiDel(name string, keys []string) (interface{}, error) {
+	params := []interface{}{name}
+	for _, v := range keys {
+		params = append(params, v)
+	}
+	return c.ProcessCmd("multi_zdel", params)
+}
+
+//rank of key in ascending order, missing key return ErrNotFound
+func (c *Client) ZRank(name string, key string) (int64, error) {
+	params := []interface{}{name, key}
+	val, err := c.ProcessCmd("zrank", params)
+	if err != nil {
+		return 0, err
+	}
+	n, err := respInt64(val, "zrank", params)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, ErrNotFound
+	}
+	return n, nil
+}
+
+//rank of key in descending order, missing key return ErrNotFound
+func (c *Client) ZRRank(name string, key string) (int64, error) {
+	params := []interface{}{name, key}
+	val, err := c.ProcessCmd("zrrank", params)
+	if err != nil {
+		return 0, err
+	}
+	n, err := respInt64(val, "zrrank", params)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, ErrNotFound
+	}
+	return n, nil
+}
+
+//count keys with score in [scoreStart, scoreEnd], empty string is no limit
+func (c *Client) ZCount(name string, scoreStart string, scoreEnd string) (int64, error) {
+	params := []interface{}{name, scoreStart, scoreEnd}
+	val, err := c.ProcessCmd("zcount", params)
+	if err != nil {
+		return 0, err
+	}
+	return respInt64(val, "zcount", params)
+}
+
+func (c *Client) ZSum(name string, scoreStart string, scoreEnd string) (int64, error) {
+	params := []interface{}{name, scoreStart, scoreEnd}
+	val, err := c.ProcessCmd("zsum", params)
+	if err != nil {
+		return 0, err
+	}
+	return respInt64(val, "zsum", params)
+}
+
+func (c *Client) ZAvg(name string, scoreStart string, scoreEnd string) (float64, error) {
+	params := []interface{}{name, scoreStart, scoreEnd}
+	val, err := c.ProcessCmd("zavg", params)
+	if err != nil {
+		return 0, err
+	}
+	avg, err := strconv.ParseFloat(fmt.Sprintf("%v", val), 64)
+	if err != nil {
+		return 0, fmt.Errorf("ZAvg response:%v is not a number:%w", val, err)
+	}
+	return avg, nil
+}
+
+func (c *Client) QClear(name string) (interface{}, error) {
+	params := []interface{}{name}
+	return c.ProcessCmd("qclear", params)
+}
+
+//add items at the front of the queue and return the new size of the queue
+func (c *Client) QPushFront(name string, items ...string) (int64, error) {
+	return c.qpush("qpush_front", name, items)
+}
+
+//add items at the back of the queue and return the new size of the queue,
+//a producer can QTrimFront when the size go over its bound
+func (c *Client) QPushBack(name string, items ...string) (int64, error) {
+	return c.qpush("qpush_back", name, items)
+}
+
+func (c *Client) qpush(cmd string, name string, items []string) (int64, error) {
+	if len(items) == 0 {
+		return 0, fmt.Errorf("%w: %s without item", ErrBadArgument, cmd)
+	}
+	params := []interface{}{name}
+	for _, v := range items {
+		params = append(params, v)
+	}
+	val, err := c.ProcessCmd(cmd, params)
+	if err != nil {
+		return 0, err
+	}
+	return respInt64(val, cmd, params)
+}
+
+//remove size items from the front and return how many were removed
+func (c *Client) QTrimFront(name string, size int) (int64, error) {
+	params := []interface{}{name, size}
+	val, err := c.ProcessCmd("qtrim_front", params)
+	if err != nil {
+		return 0, err
+	}
+	return respInt64(val, "qtrim_front", params)
+}
+
+//remove size items from the back and return how many were removed
+func (c *Client) QTrimBack(name string, size int) (int64, error) {
+	params := []interface{}{name, size}
+	val, err := c.ProcessCmd("qtrim_back", params)
+	if err != nil {
+		return 0, err
+	}
+	return respInt64(val, "qtrim_back", params)
+}
+
+//get the item at index, out of range index return ErrNotFound
+func (c *Client) QGet(name string, index int) (string, error) {
+	params := []interface{}{name, index}
+	val, err := c.ProcessCmd("qget", params)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v", val), nil
+}
+
+func (c *Client) QSet(name string, index int, val string) (interface{}, error) {
+	params := []interface{}{name, index, val}
+	return c.ProcessCmd("qset", params)
+}
+
+// Info return the server info key/value pairs
+func (c *Client) Info() (map[string]string, error) {
+	resp, err := c.Do("info")
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) == 0 || resp[0] != "ok" {
+		return nil, fmt.Errorf("bad response:%v args:%v", resp, "info")
+	}
+	data := resp[1:]
+	// response start with the server name "ssdb-server" before the pairs
+	if len(data)%2 == 1 {
+		data = data[1:]
+	}
+	info := make(map[string]string)
+	for i := 0; i < len(data); i += 2 {
+		info[data[i]] = data[i+1]
+	}
+	return info, nil
+}
+
+type ServerInfo struct {
+	Version    string
+	Links      int64
+	TotalCalls int64
+	DBSize     int64
+	Raw        map[string]string
+}
+
+// ServerInfo return the known info fields parsed
+func (c *Client) ServerInfo() (*ServerInfo, error) {
+	info, err := c.Info()
+	if err != nil {
+		return nil, err
+	}
+	si := &ServerInfo{Version: info["version"], Raw: info}
+	si.Links, _ = strconv.ParseInt(info["links"], 10, 64)
+	si.TotalCalls, _ = strconv.ParseInt(info["total_calls"], 10, 64)
+	si.DBSize, _ = strconv.ParseInt(info["dbsize"], 10, 64)
+	return si, nil
+}
+
+// ServerVersion return the version reported by the info command
+func (c *Client) ServerVersion() (string, error) {
+	info, err := c.Info()
+	if err != nil {
+		return "", err
+	}
+	v, ok := info["version"]
+	if !ok || v == "" {
+		return "", fmt.Errorf("ssdb: no version in info response")
+	}
+	return v, nil
+}
+
+// DBSize return the approximate size of the database in bytes
+func (c *Client) DBSize() (int64, error) {
+	params := []interface{}{}
+	val, err := c.ProcessCmd("dbsize", params)
+	if err != nil {
+		return 0, err
+	}
+	return respInt64(val, "dbsize", params)
+}
+
+// FlushDB delete ALL data of the given type ("" for all, "kv", "hash", "zset", "queue").
+// WARNING: data loss can not be undone, use it on test databases only.
+func (c *Client) FlushDB(dataType string) error {
+	if c == nil {
+		return fmt.Errorf("ssdb: FlushDB on nil client")
+	}
+	params := []interface{}{}
+	if dataType != "" {
+		params = append(params, dataType)
+	}
+	_, err := c.ProcessCmd("flushdb", params)
+	return err
+}
+
+// Compact run a leveldb compaction on the server, it is bound by the command timeout
+func (c *Client) Compact() error {
+	return c.CompactContext(context.Background())
+}
+
+// CompactContext is Compact with a context, a deadline on ctx replace the command timeout
+// so a long compaction can be given more time than the other commands
+func (c *Client) CompactContext(ctx context.Context) error {
+	args := []interface{}{"compact"}
+	if deadline, ok := ctx.Deadline(); ok {
+		ms := int(time.Until(deadline) / time.Millisecond)
+		if ms <= 0 {
+			return fmt.Errorf("%w: %w", ErrTimeout, context.DeadlineExceeded)
+		}
+		args = ArrayAppendToFirst([]interface{}{ms}, args)
 	}
-	return c.ProcessCmd("multi_hset", params)
+	resp, err := c.DoContext(ctx, args...)
+	if err != nil {
+		return err
+	}
+	if status, _, err := ParseStatus(resp); status != StatusOK {
+		return err
+	}
+	return nil
 }
 
-func (c *Client) HashMultiGet(hash string, keys []string) (map[string]string, error) {
-	params := []interface{}{hash}
-	for _, v := range keys {
-		params = append(params, v)
-	}
-	val, err := c.ProcessCmd("multi_hget", params)
+// ListAllowIP return the ip rules of the server allow list
+func (c *Client) ListAllowIP() ([]string, error) {
+	val, err := c.ProcessCmd("list_allow_ip", []interface{}{})
 	if err != nil {
 		return nil, err
-	} else {
-		return val.(map[string]string), err
 	}
-	return nil, fmt.Errorf("data has empty")
+	return respStrings(val), nil
 }
 
-func (c *Client) HashMultiDel(hash string, keys []string) (interface{}, error) {
-	params := []interface{}{hash}
-	for _, v := range keys {
-		params = append(params, v)
-	}
-	return c.ProcessCmd("multi_hdel", params)
+// AddAllowIP add an ip rule to the server allow list, it need an admin connection
+func (c *Client) AddAllowIP(ip string) error {
+	params := []interface{}{ip}
+	_, err := c.ProcessCmd("add_allow_ip", params)
+	return err
 }
 
-func (c *Client) HashClear(hash string) (interface{}, error) {
-	params := []interface{}{hash}
-	return c.ProcessCmd("hclear", params)
+// DelAllowIP remove an ip rule from the server allow list, it need an admin connection
+func (c *Client) DelAllowIP(ip string) error {
+	params := []interface{}{ip}
+	_, err := c.ProcessCmd("del_allow_ip", params)
+	return err
 }
 
 func (c *Client) Zip(data []byte) string {
-	var zipbuf bytes.Buffer
-	w := gzip.NewWriter(&zipbuf)
-	w.Write(data)
-	w.Close()
-	zipbuff := base64.StdEncoding.EncodeToString(zipbuf.Bytes())
-	return zipbuff
+	return c.codec().Compress(data)
+}
+
+// formatArg turn one command argument into its wire values, the elements of
+// []string and []interface{} become one value each and are formatted like top-level args
+func formatArg(idx int, arg interface{}) ([]string, error) {
+	switch arg := arg.(type) {
+	case []string:
+		return arg, nil
+	case []interface{}:
+		items := make([]string, 0, len(arg))
+		for i, v := range arg {
+			s, ok := formatValue(v)
+			if !ok {
+				return nil, fmt.Errorf("%w: index %d.%d type %T", ErrBadArgument, idx, i, v)
+			}
+			items = append(items, s)
+		}
+		return items, nil
+	}
+	s, ok := formatValue(arg)
+	if !ok {
+		return nil, fmt.Errorf("%w: index %d type %T", ErrBadArgument, idx, arg)
+	}
+	return []string{s}, nil
+}
+
+func formatValue(arg interface{}) (string, bool) {
+	switch arg := arg.(type) {
+	case string:
+		return arg, true
+	case []byte:
+		return string(arg), true
+	case int:
+		return fmt.Sprintf("%d", arg), true
+	case int64:
+		return fmt.Sprintf("%d", arg), true
+	case float64:
+		return fmt.Sprintf("%f", arg), true
+	case bool:
+		if arg {
+			return "1", true
+		}
+		return "0", true
+	case nil:
+		return "", true
+	}
+	return "", false
 }
 
 func (c *Client) Send(args []interface{}) error {
 	var buf bytes.Buffer
+	if err := c.encode(&buf, args); err != nil {
+		return err
+	}
 	var err error
+	// [GDNS-3721] support tls connection
+	if conn := c.conn(); conn != nil {
+		err = writeFull(conn, buf.Bytes())
+	} else {
+		err = ErrConnClosed
+	}
+	return err
+}
+
+// writeFull write all of p, a short write is retried with the rest
+// and a write that make no progress without error fail with io.ErrShortWrite
+func writeFull(w io.Writer, p []byte) error {
+	for len(p) > 0 {
+		n, err := w.Write(p)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return io.ErrShortWrite
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// sendAll write cmds back-to-back, with a write buffer the commands are gathered
+// and flushed every writeBuffer bytes so a long pipeline cost a few syscalls only
+func (c *Client) sendAll(cmds [][]interface{}) error {
+	if c.writeBuffer <= 0 {
+		for _, args := range cmds {
+			if err := c.Send(args); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	conn := c.conn()
+	if conn == nil {
+		return fmt.Errorf("lost connection")
+	}
+	var buf bytes.Buffer
+	for _, args := range cmds {
+		if err := c.encode(&buf, args); err != nil {
+			return err
+		}
+		if buf.Len() >= c.writeBuffer {
+			if err := writeFull(conn, buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+	}
+	if buf.Len() > 0 {
+		if err := writeFull(conn, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encode append the wire form of one command to buf, nothing is appended on a bad argument
+func (c *Client) encode(buf *bytes.Buffer, args []interface{}) error {
+	// validate every argument before any byte is written
+	var items []string
+	for i, arg := range args {
+		values, err := formatArg(i, arg)
+		if err != nil {
+			return fmt.Errorf("[%s]send %w args:%v", c.Id, err, args)
+		}
+		items = append(items, values...)
+	}
 	if c.zip {
 		buf.WriteString("3")
 		buf.WriteByte('\n')
 		buf.WriteString("zip")
 		buf.WriteByte('\n')
-		var zipbuf bytes.Buffer
-		w := gzip.NewWriter(&zipbuf)
-		for _, arg := range args {
-			var s string
-			switch arg := arg.(type) {
-			case string:
-				s = arg
-			case []byte:
-				s = string(arg)
-			case []string:
-				for _, s := range arg {
-					w.Write([]byte(fmt.Sprintf("%d", len(s))))
-					w.Write([]byte("\n"))
-					w.Write([]byte(s))
-					w.Write([]byte("\n"))
-				}
-				continue
-			case int:
-				s = fmt.Sprintf("%d", arg)
-			case int64:
-				s = fmt.Sprintf("%d", arg)
-			case float64:
-				s = fmt.Sprintf("%f", arg)
-			case bool:
-				if arg {
-					s = "1"
-				} else {
-					s = "0"
-				}
-			case nil:
-				s = ""
-			case []interface{}:
-				for _, s := range arg {
-					buf.WriteString(fmt.Sprintf("%d", len(s.(string))))
-					buf.WriteByte('\n')
-					buf.WriteString(s.(string))
-					buf.WriteByte('\n')
-				}
-				continue
-			default:
-				return fmt.Errorf("[%s]zip send bad arguments:%v", c.Id, args)
-			}
-			w.Write([]byte(fmt.Sprintf("%d", len(s))))
-			w.Write([]byte("\n"))
-			w.Write([]byte(s))
-			w.Write([]byte("\n"))
+		var raw bytes.Buffer
+		for _, s := range items {
+			raw.WriteString(fmt.Sprintf("%d", len(s)))
+			raw.WriteByte('\n')
+			raw.WriteString(s)
+			raw.WriteByte('\n')
 		}
-		w.Close()
-		zipbuff := base64.StdEncoding.EncodeToString(zipbuf.Bytes())
+		zipbuff := c.codec().Compress(raw.Bytes())
 		buf.WriteString(fmt.Sprintf("%d", len(zipbuff)))
 		buf.WriteByte('\n')
 		buf.WriteString(zipbuff)
 		buf.WriteByte('\n')
 		buf.WriteByte('\n')
 	} else {
-		for _, arg := range args {
-			var s string
-			switch arg := arg.(type) {
-			case string:
-				s = arg
-			case []byte:
-				s = string(arg)
-			case []string:
-				for _, s := range arg {
-					buf.WriteString(fmt.Sprintf("%d", len(s)))
-					buf.WriteByte('\n')
-					_, err := buf.WriteString(s)
-					if err != nil {
-						log.Println("Write String Error:", err)
-					}
-					buf.WriteByte('\n')
-				}
-				continue
-			case int:
-				s = fmt.Sprintf("%d", arg)
-			case int64:
-				s = fmt.Sprintf("%d", arg)
-			case float64:
-				s = fmt.Sprintf("%f", arg)
-			case bool:
-				if arg {
-					s = "1"
-				} else {
-					s = "0"
-				}
-			case nil:
-				s = ""
-			case []interface{}:
-				for _, s := range arg {
-					buf.WriteString(fmt.Sprintf("%d", len(s.(string))))
-					buf.WriteByte('\n')
-					buf.WriteString(s.(string))
-					buf.WriteByte('\n')
-				}
-				continue
-			default:
-				return fmt.Errorf("[%s]public send bad arguments:%v type:%v", c.Id, args, arg)
-			}
+		for _, s := range items {
 			buf.WriteString(fmt.Sprintf("%d", len(s)))
 			buf.WriteByte('\n')
 			buf.WriteString(s)
@@ -994,143 +3263,165 @@ func (c *Client) Send(args []interface{}) error {
 		}
 		buf.WriteByte('\n')
 	}
-	tmpBuf := buf.Bytes()
-	// [GDNS-3721] support tls connection
-	if c.tlsInfo.enable {
-		_, err = c.tlsInfo.conn.Write(tmpBuf)
-	} else {
-		_, err = c.sock.Write(tmpBuf)
-	}
-	return err
+	return nil
 }
 
 // 目前沒在用這個send
 func (c *Client) send(args []interface{}) error {
 	var buf bytes.Buffer
 	var err error
-	for _, arg := range args {
-		var s string
-		switch arg := arg.(type) {
-		case string:
-			s = arg
-		case []byte:
-			s = string(arg)
-		case []string:
-			for _, s := range arg {
-				buf.WriteString(fmt.Sprintf("%d", len(s)))
-				buf.WriteByte('\n')
-				buf.WriteString(s)
-				buf.WriteByte('\n')
-			}
-			continue
-		case int:
-			s = fmt.Sprintf("%d", arg)
-		case int64:
-			s = fmt.Sprintf("%d", arg)
-		case float64:
-			s = fmt.Sprintf("%f", arg)
-		case bool:
-			if arg {
-				s = "1"
-			} else {
-				s = "0"
-			}
-		case []interface{}:
-			for _, s := range arg {
-				buf.WriteString(fmt.Sprintf("%d", len(s.(string))))
-				buf.WriteByte('\n')
-				buf.WriteString(s.(string))
-				buf.WriteByte('\n')
-			}
-			continue
-		case nil:
-			s = ""
-		default:
-			return fmt.Errorf("private send bad arguments:%v", args)
+	for i, arg := range args {
+		values, err := formatArg(i, arg)
+		if err != nil {
+			return fmt.Errorf("private send %w args:%v", err, args)
+		}
+		for _, s := range values {
+			buf.WriteString(fmt.Sprintf("%d", len(s)))
+			buf.WriteByte('\n')
+			buf.WriteString(s)
+			buf.WriteByte('\n')
 		}
-		buf.WriteString(fmt.Sprintf("%d", len(s)))
-		buf.WriteByte('\n')
-		buf.WriteString(s)
-		buf.WriteByte('\n')
 	}
 	buf.WriteByte('\n')
 	// [GDNS-3721] support tls connection
-	if c.tlsInfo.enable {
-		_, err = c.tlsInfo.conn.Write(buf.Bytes())
+	if conn := c.conn(); conn != nil {
+		err = writeFull(conn, buf.Bytes())
 	} else {
-		_, err = c.sock.Write(buf.Bytes())
+		err = ErrConnClosed
 	}
 	return err
 }
 
-func (c *Client) batchSubSend(wg *sync.WaitGroup, batchArgs [][]interface{}) error {
-	defer wg.Done()
-	for _, args := range batchArgs {
+// BatchError is one failed command of BatchSend, Index is its position in batchArgs
+type BatchError struct {
+	Index int
+	Args  []interface{}
+	Err   error
+}
+
+func (e BatchError) Error() string {
+	return fmt.Sprintf("batch[%d] args:%v error:%v", e.Index, e.Args, e.Err)
+}
+
+// batchSubSend run one chunk on c starting at offset of the whole batch, every command is tried
+func (c *Client) batchSubSend(offset int, batchArgs [][]interface{}) []BatchError {
+	var failed []BatchError
+	for i, args := range batchArgs {
 		//sometime will request loss.
 		/*err := c.send(args)
 		if err != nil {
-			log.Println("batchSubSend:", args, err)
+			c.logln("batchSubSend:", args, err)
 		}
 		time.Sleep(100 * time.Microsecond)*/
-		_, err := c.Do(args)
+		resp, err := c.Do(args)
+		if err == nil {
+			if status, _, serr := ParseStatus(resp); status == StatusError {
+				err = serr
+			}
+		}
 		if err != nil {
-			log.Println("batchSubSend:", args, err)
+			c.logln("batchSubSend:", args, err)
+			failed = append(failed, BatchError{Index: offset + i, Args: args, Err: err})
 		}
 	}
-	return nil
+	return failed
 }
 
-func (c *Client) BatchSend(batchArgs [][]interface{}, tlsMode bool, caCrt []byte) error {
-	var privatePool []*Client
-	wg := &sync.WaitGroup{}
+// BatchSend run batchArgs in chunks of 2000 commands over at most batchConns connections
+// (see WithBatchConns), it return every failed command ordered by Index and an error
+// summing up the chunks that failed.
+// Connections that can not be established are skipped and their chunks go to the others,
+// when none is established nothing is sent and only the error is returned.
+// tlsMode and caCrt are kept for compatibility, the inner connections use the settings of c
+func (c *Client) BatchSend(batchArgs [][]interface{}, tlsMode bool, caCrt []byte) ([]BatchError, error) {
 	splitSize := 2000
-	connNum := len(batchArgs) / splitSize
-	if connNum < 1 {
-		connNum = 1
-	}
-
 	var splitArgs [][][]interface{}
-
-	if len(batchArgs) >= splitSize {
-		pics := int(len(batchArgs) / splitSize)
-		currentSize := len(batchArgs)
-		for i := 0; i <= pics; i++ {
-			start := i * splitSize
-			if start >= currentSize {
-				start = currentSize
-			}
-			end := (i + 1) * splitSize
-			if end >= currentSize {
-				end = currentSize
-			}
-			if start != end {
-				splitArgs = append(splitArgs, batchArgs[start:end])
-			}
+	for start := 0; start < len(batchArgs); start += splitSize {
+		end := start + splitSize
+		if end > len(batchArgs) {
+			end = len(batchArgs)
 		}
-	} else {
-		splitArgs = append(splitArgs, batchArgs)
+		splitArgs = append(splitArgs, batchArgs[start:end])
 	}
-	connNum = len(splitArgs)
-	if debug {
-		log.Printf("BatchSend Total:%d Connection:%d ip:%v port:%v\n", len(batchArgs), connNum, c.Ip, c.Port)
+	if len(splitArgs) == 0 {
+		return nil, nil
 	}
+	connNum := c.batchConns
+	if connNum <= 0 {
+		connNum = defaultBatchConns
+	}
+	if connNum > len(splitArgs) {
+		connNum = len(splitArgs)
+	}
+	if c.debug {
+		c.logf("BatchSend Total:%d Chunk:%d Connection:%d ip:%v port:%v\n", len(batchArgs), len(splitArgs), connNum, c.Ip, c.Port)
+	}
+
+	// connect first so the chunks are only shared by the connections that are up
+	conns := make([]*Client, connNum)
+	dialErrs := make([]error, connNum)
+	wg := &sync.WaitGroup{}
+	wg.Add(connNum)
 	for i := 0; i < connNum; i++ {
-		innerClient, err := Connect(c.Ip, c.Port, c.Password, tlsMode, caCrt)
-		if err != nil {
-			log.Printf("BatchSend[%v]:%v\n", i, err)
+		go func(worker int) {
+			defer wg.Done()
+			innerClient, err := c.Clone()
+			if err != nil {
+				c.logf("BatchSend[%v]:%v\n", worker, err)
+				if innerClient != nil {
+					innerClient.Close()
+				}
+				dialErrs[worker] = err
+				return
+			}
+			conns[worker] = innerClient
+		}(i)
+	}
+	wg.Wait()
+	var live []*Client
+	for _, innerClient := range conns {
+		if innerClient != nil {
+			live = append(live, innerClient)
 		}
-		privatePool = append(privatePool, innerClient)
-		//result,err := innerClient.Do("ping")
 	}
-	wg.Add(connNum)
-	for idx, args := range splitArgs {
-		privatePool[idx].batchSubSend(wg, args)
+	if len(live) == 0 {
+		return nil, fmt.Errorf("BatchSend no connection established, first:%w", dialErrs[0])
+	}
+	if c.debug && len(live) < connNum {
+		c.logf("BatchSend %d of %d connections failed, sending on %d\n", connNum-len(live), connNum, len(live))
+	}
+
+	chunks := make(chan int)
+	chunkErrs := make([][]BatchError, len(splitArgs))
+	wg.Add(len(live))
+	for _, innerClient := range live {
+		go func(innerClient *Client) {
+			defer wg.Done()
+			for idx := range chunks {
+				chunkErrs[idx] = innerClient.batchSubSend(idx*splitSize, splitArgs[idx])
+			}
+			// batchSubSend wait every reply, nothing is left in flight
+			innerClient.Close()
+		}(innerClient)
 	}
+	for idx := range splitArgs {
+		chunks <- idx
+	}
+	close(chunks)
 	wg.Wait()
-	for _, conn := range privatePool {
-		conn.Close()
+
+	var failed []BatchError
+	var msgs []string
+	for idx, errs := range chunkErrs {
+		if len(errs) > 0 {
+			failed = append(failed, errs...)
+			msgs = append(msgs, fmt.Sprintf("chunk[%d]:%d of %d commands failed, first:%v", idx, len(errs), len(splitArgs[idx]), errs[0]))
+		}
 	}
-	return nil
+	if len(msgs) > 0 {
+		return failed, fmt.Errorf("BatchSend %d of %d chunks failed: %s", len(msgs), len(splitArgs), strings.Join(msgs, "; "))
+	}
+	return nil, nil
 }
 
 func (c *Client) Recv() ([]string, error) {
@@ -1138,38 +3429,129 @@ func (c *Client) Recv() ([]string, error) {
 }
 
 func (c *Client) recv() ([]string, error) {
-	var tmp [102400]byte
-	var n int
-	var err error
 	for {
-		resp := c.parse()
+		resp, err := c.parse()
+		if err != nil {
+			// the rest of the stream can not be framed anymore
+			c.recv_buf.Reset()
+			return nil, err
+		}
 		if resp == nil || len(resp) > 0 {
 			//log.Println("SSDB Receive:",resp)
 			if len(resp) > 0 && resp[0] == "zip" {
 				//log.Println("SSDB Receive Zip\n",resp)
-				zipData, err := base64.StdEncoding.DecodeString(resp[1])
+				if len(resp) < 2 {
+					return nil, fmt.Errorf("bad zip response:%v", resp)
+				}
+				zipData, err := c.codec().Decompress(resp[1])
 				if err != nil {
 					return nil, err
 				}
+				if c.maxResponse > 0 && len(zipData) > c.maxResponse {
+					return nil, fmt.Errorf("%w: unzip size %d over %d", ErrResponseTooLarge, len(zipData), c.maxResponse)
+				}
 				resp = c.tranfUnZip(zipData)
 			}
 			return resp, nil
 		}
-		// [GDNS-3721] support tls connection
-		if c.tlsInfo.enable {
-			n, err = c.tlsInfo.conn.Read(tmp[0:])
-		} else {
-			n, err = c.sock.Read(tmp[0:])
+		if err := c.readMore(); err != nil {
+			return nil, err
 		}
+	}
+}
+
+// recvBytes is recv keeping every value as bytes, for binary values like protobuf or gob blobs
+func (c *Client) recvBytes() ([][]byte, error) {
+	for {
+		resp, err := c.parseBytes()
 		if err != nil {
+			// the rest of the stream can not be framed anymore
+			c.recv_buf.Reset()
+			return nil, err
+		}
+		if resp == nil || len(resp) > 0 {
+			if len(resp) > 0 && string(resp[0]) == "zip" {
+				if len(resp) < 2 {
+					return nil, fmt.Errorf("bad zip response:%q", resp)
+				}
+				zipData, err := c.codec().Decompress(string(resp[1]))
+				if err != nil {
+					return nil, err
+				}
+				if c.maxResponse > 0 && len(zipData) > c.maxResponse {
+					return nil, fmt.Errorf("%w: unzip size %d over %d", ErrResponseTooLarge, len(zipData), c.maxResponse)
+				}
+				values := c.tranfUnZip(zipData)
+				resp = make([][]byte, 0, len(values))
+				for _, v := range values {
+					resp = append(resp, []byte(v))
+				}
+			}
+			return resp, nil
+		}
+		if err := c.readMore(); err != nil {
 			return nil, err
 		}
-		c.recv_buf.Write(tmp[0:n])
 	}
 }
 
-func (c *Client) parse() []string {
-	resp := []string{}
+// readMore read the connection once into recv_buf
+func (c *Client) readMore() error {
+	var tmp [102400]byte
+	var n int
+	var err error
+	// [GDNS-3721] support tls connection
+	if conn := c.conn(); conn != nil {
+		n, err = conn.Read(tmp[0:])
+	} else {
+		err = ErrConnClosed
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			return fmt.Errorf("%w: %v", ErrConnClosed, err)
+		}
+		return err
+	}
+	c.recv_buf.Write(tmp[0:n])
+	if c.maxResponse > 0 && c.recv_buf.Len() > c.maxResponse {
+		size := c.recv_buf.Len()
+		c.recv_buf.Reset()
+		return fmt.Errorf("%w: buffer size %d over %d", ErrResponseTooLarge, size, c.maxResponse)
+	}
+	return nil
+}
+
+// parse return the values of one complete response, an empty slice when more data is needed
+// and nil for a broken frame
+func (c *Client) parse() ([]string, error) {
+	values, err := c.parseValues()
+	if values == nil || err != nil {
+		return nil, err
+	}
+	resp := make([]string, 0, len(values))
+	for _, v := range values {
+		resp = append(resp, string(v))
+	}
+	return resp, nil
+}
+
+// parseBytes is parse with the values copied out of recv_buf as bytes
+func (c *Client) parseBytes() ([][]byte, error) {
+	values, err := c.parseValues()
+	if values == nil || err != nil {
+		return nil, err
+	}
+	resp := make([][]byte, 0, len(values))
+	for _, v := range values {
+		resp = append(resp, append([]byte(nil), v...))
+	}
+	return resp, nil
+}
+
+// parseValues frame one response of recv_buf, the values point into recv_buf
+// and must be copied before the next read
+func (c *Client) parseValues() ([][]byte, error) {
+	resp := [][]byte{}
 	buf := c.recv_buf.Bytes()
 	var Idx, offset int
 	Idx = 0
@@ -1185,51 +3567,47 @@ func (c *Client) parse() []string {
 		p := buf[offset : offset+Idx]
 		offset += Idx + 1
 		//fmt.Printf("> [%s]\n", p);
-		if len(p) == 0 || (len(p) == 1 && p[0] == '\r') {
+		// only the length and blank lines may end with \r\n, values are framed by their length
+		p = bytes.TrimSuffix(p, []byte{'\r'})
+		if len(p) == 0 {
 			if len(resp) == 0 {
 				continue
 			} else {
 				c.recv_buf.Next(offset)
-				return resp
+				c.mu.Lock()
+				c.lastResponse = offset
+				c.mu.Unlock()
+				return resp, nil
 			}
 		}
-		pIdx := strings.Replace(strconv.Quote(string(p)), `"`, ``, -1)
-		size, err := strconv.Atoi(pIdx)
+		size, err := strconv.Atoi(string(p))
 		if err != nil || size < 0 {
 			//log.Printf("SSDB Parse Error:%v data:%v\n",err,pIdx)
-			return nil
+			return nil, nil
+		}
+		if c.maxResponse > 0 && size > c.maxResponse {
+			return nil, fmt.Errorf("%w: value size %d over %d", ErrResponseTooLarge, size, c.maxResponse)
 		}
 		//fmt.Printf("packet size:%d\n",size);
-		if offset+size >= c.recv_buf.Len() {
+		// the value needs size bytes plus its trailing '\n' in the buffer,
+		// a value ending exactly at the buffer end is complete once that '\n' arrived
+		if offset+size+1 > len(buf) {
 			//tmpLen := offset+size
 			//fmt.Printf("buf size too big:%d > buf len:%d\n",tmpLen,c.recv_buf.Len());
 			break
 		}
 
 		v := buf[offset : offset+size]
-		resp = append(resp, string(v))
+		resp = append(resp, v)
 		offset += size + 1
 	}
 
 	//fmt.Printf("buf.size: %d packet not ready...\n", len(buf))
-	return []string{}
+	return [][]byte{}, nil
 }
 
-//this function for transfer data only use.
-func (c *Client) tranfUnZip(data []byte) []string {
-	var buf bytes.Buffer
-	buf.Write(data)
-	zipReader, err := gzip.NewReader(&buf)
-	if err != nil {
-		log.Println("[ERROR] New gzip reader:", err)
-	}
-	defer zipReader.Close()
-
-	zipData, err := ioutil.ReadAll(zipReader)
-	if err != nil {
-		fmt.Println("[ERROR] ReadAll:", err)
-		return nil
-	}
+//this function for transfer data only use, zipData is the decompressed payload.
+func (c *Client) tranfUnZip(zipData []byte) []string {
 	var resp []string
 
 	if zipData != nil {
@@ -1241,7 +3619,7 @@ func (c *Client) tranfUnZip(data []byte) []string {
 			if Idx == -1 {
 				break
 			}
-			p := string(zipData[:Idx])
+			p := string(bytes.TrimSuffix(zipData[:Idx], []byte{'\r'}))
 			//fmt.Println("p:[",p,"]\n")
 			size, err := strconv.Atoi(string(p))
 			if err != nil || size < 0 {
@@ -1250,6 +3628,10 @@ func (c *Client) tranfUnZip(data []byte) []string {
 			} else {
 				offset = Idx + 1 + size
 				hiIdx = size + Idx + 1
+				if hiIdx > len(zipData) {
+					c.logf("[ERROR] zip value size:%d over data length:%d\n", size, len(zipData))
+					return nil
+				}
 				resp = append(resp, string(zipData[Idx+1:hiIdx]))
 				//fmt.Printf("data:[%s] size:%d Idx:%d\n",str,size,Idx+1)
 				zipData = zipData[offset:]
@@ -1261,54 +3643,100 @@ func (c *Client) tranfUnZip(data []byte) []string {
 }
 
 func (c *Client) UnZip(data string) ([]byte, error) {
-	var buf bytes.Buffer
-	zipData, err := base64.StdEncoding.DecodeString(data)
+	unzipData, err := c.codec().Decompress(data)
 	if err != nil {
+		c.logln("[ERROR] UnZip:", err)
 		return []byte{}, err
 	}
-	buf.Write(zipData)
-	zipReader, err := gzip.NewReader(&buf)
-	if err != nil {
-		log.Println("[ERROR] New gzip reader:", err)
-	}
-	defer zipReader.Close()
+	return unzipData, nil
+}
 
-	unzipData, err := ioutil.ReadAll(zipReader)
-	if err != nil {
-		fmt.Println("[ERROR] ReadAll:", err)
-		return []byte{}, err
+// Reset put a closed client back into service, it wait for the old processDo to exit
+// then re-dial and start a new one, calling it on a client not closed do nothing.
+// When the dial fails the client is closed again, so Reset can be called once more
+func (c *Client) Reset() error {
+	c.mu.Lock()
+	if !c.Closed {
+		c.mu.Unlock()
+		return nil
 	}
-	buf.Reset()
-	return unzipData, nil
+	done := c.processDone
+	c.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+	c.mu.Lock()
+	c.init = false
+	c.quit = nil
+	c.processDone = nil
+	c.stopHealth = make(chan struct{})
+	c.recv_buf.Reset()
+	c.Retry = false
+	c.termErr = nil
+	c.Closed = false
+	c.mu.Unlock()
+	if err := c.Connect(); err != nil {
+		c.Close()
+		return err
+	}
+	return nil
 }
 
 // Close The Client Connection
 func (c *Client) Close() error {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("Recovered in Close", r)
-		}
-	}()
-	if c != nil && !c.Closed {
-		c.mu.Lock()
-		c.Connected = false
-		c.Closed = true
+	return c.CloseGracefully(0)
+}
+
+// CloseGracefully stop accepting new commands and wait up to timeout
+// for in-flight commands and the processDo loop to finish before closing the socket.
+// The connection stay up while draining, so the commands already queued still run and
+// get their response. Past the timeout a command not yet taken by processDo fail with
+// ErrConnClosed and the running one get the error of the closed socket.
+func (c *Client) CloseGracefully(timeout time.Duration) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	if c.Closed {
 		c.mu.Unlock()
-		if c.process != nil {
-			close(c.process)
+		return nil
+	}
+	// Closed alone make enter refuse new callers, Connected is kept for the drain
+	c.Closed = true
+	stopHealth, quit, done := c.stopHealth, c.quit, c.processDone
+	c.mu.Unlock()
+	c.setState(StateClosed)
+	if stopHealth != nil {
+		close(stopHealth)
+	}
+	deadline := time.After(timeout)
+	if timeout > 0 {
+		drained := make(chan struct{})
+		go func() {
+			c.inflight.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-deadline:
+			c.logf("Client[%s] close timeout in %v with commands in-flight.\n", c.Id, timeout)
 		}
-		// [GDNS-3721] support tls connection
-		if c.tlsInfo.enable {
-			if c.tlsInfo.conn != nil {
-				c.tlsInfo.conn.Close()
-			}
-		} else {
-			if c.sock != nil {
-				c.sock.Close()
+	}
+	if quit != nil {
+		close(quit)
+		if timeout > 0 {
+			select {
+			case <-done:
+			case <-deadline:
 			}
 		}
-		c = nil
 	}
-
+	c.mu.Lock()
+	c.Connected = false
+	c.mu.Unlock()
+	// [GDNS-3721] support tls connection
+	if conn := c.conn(); conn != nil {
+		conn.Close()
+	}
 	return nil
 }
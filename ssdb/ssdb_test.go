@@ -0,0 +1,1032 @@
+package ssdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nxgtw/gossdb-tls/ssdb/ssdbtest"
+)
+
+// connectMock start a mock server for the test and return a client connected to it
+func connectMock(t testing.TB, opts ...Option) *Client {
+	t.Helper()
+	addr, _ := ssdbtest.StartMockServerTB(t)
+	return connectAddr(t, addr, "", opts...)
+}
+
+func connectAddr(t testing.TB, addr string, auth string, opts ...Option) *Client {
+	t.Helper()
+	host, port := splitAddr(t, addr)
+	c, err := Connect(host, port, auth, false, nil, opts...)
+	if err != nil {
+		t.Fatalf("connect %s: %v", addr, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func splitAddr(t testing.TB, addr string) (string, int) {
+	t.Helper()
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, port
+}
+
+func TestCloseWhileSending(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		c := connectMock(t)
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				for j := 0; j < 20; j++ {
+					resp, err := c.Do("set", "k"+strconv.Itoa(i), j)
+					if err == nil && len(resp) == 0 {
+						t.Errorf("Do returned no response and no error")
+						return
+					}
+				}
+			}(i)
+		}
+		close(start)
+		c.Close()
+		wg.Wait()
+		if _, err := c.Do("get", "k0"); err == nil {
+			t.Fatal("Do after Close succeeded")
+		}
+	}
+}
+
+// silentServer accept connections and never answer, so commands stay in flight
+func silentServer(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+	})
+	return ln.Addr().String()
+}
+
+func TestCloseWithQueuedCallers(t *testing.T) {
+	c := connectAddr(t, silentServer(t), "")
+	var wg sync.WaitGroup
+	errs := make(chan error, 30)
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.Do("get", "a")
+			errs <- err
+		}()
+	}
+	// one command hold processDo on the silent socket, the others wait to be queued
+	time.Sleep(100 * time.Millisecond)
+	c.Close()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err == nil {
+			t.Fatal("a command lost by Close was reported as success")
+		}
+	}
+}
+
+func TestCloseGracefullyDrainQueued(t *testing.T) {
+	addr := scriptServer(t, func(req []string) []string {
+		if req[0] == "slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return []string{"ok", req[0]}
+	})
+	c := connectAddr(t, addr, "")
+	var wg sync.WaitGroup
+	errs := make(chan error, 11)
+	run := func(cmd string) {
+		defer wg.Done()
+		resp, err := c.Do(cmd)
+		if err == nil && (len(resp) != 2 || resp[1] != cmd) {
+			t.Errorf("%s got %v", cmd, resp)
+		}
+		errs <- err
+	}
+	wg.Add(1)
+	go run("slow")
+	time.Sleep(50 * time.Millisecond)
+	// the others queue behind the slow reply before the close start
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go run("ping")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := c.CloseGracefully(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("queued command failed during CloseGracefully: %v", err)
+		}
+	}
+	if _, err := c.Do("ping"); err == nil {
+		t.Fatal("Do after CloseGracefully succeeded")
+	}
+}
+
+func TestRetryConnectStopOnAuthFailure(t *testing.T) {
+	first, stopFirst := ssdbtest.StartMockServerAuthTB(t, "old")
+	second, _ := ssdbtest.StartMockServerAuthTB(t, "new")
+	var mu sync.Mutex
+	target := first
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return new(net.Dialer).DialContext(ctx, network, target)
+	}
+	c := connectAddr(t, first, "old", WithDialer(dial), WithReconnectBackoff(time.Millisecond, 10*time.Millisecond, 0))
+	// the server restart with another password, the reconnect must give up
+	mu.Lock()
+	target = second
+	mu.Unlock()
+	stopFirst()
+	c.Do("get", "a")
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !errors.Is(c.Err(), ErrAuthFailed) {
+		t.Fatalf("Err() = %v, want ErrAuthFailed", c.Err())
+	}
+	if _, err := c.Do("get", "a"); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("Do after auth failure = %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestResetAfterFailedReset(t *testing.T) {
+	good, _ := ssdbtest.StartMockServerAuthTB(t, "pwd")
+	other, _ := ssdbtest.StartMockServerAuthTB(t, "other")
+	var mu sync.Mutex
+	target := good
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if target == "" {
+			return nil, errors.New("server down")
+		}
+		return new(net.Dialer).DialContext(ctx, network, target)
+	}
+	c := connectAddr(t, good, "pwd", WithDialer(dial))
+	// a failed dial, then a dial whose auth is refused after processDo started
+	for _, down := range []string{"", other} {
+		c.Close()
+		mu.Lock()
+		target = down
+		mu.Unlock()
+		if err := c.Reset(); err == nil {
+			t.Fatalf("Reset to %q succeeded", down)
+		}
+		if _, err := c.Do("get", "a"); err == nil {
+			t.Fatal("Do after a failed Reset succeeded")
+		}
+	}
+	mu.Lock()
+	target = good
+	mu.Unlock()
+	if err := c.Reset(); err != nil {
+		t.Fatalf("Reset after a failed one: %v", err)
+	}
+	if _, err := c.Set("a", "1"); err != nil {
+		t.Fatalf("set after Reset: %v", err)
+	}
+}
+
+func TestParseExactResponse(t *testing.T) {
+	c := newClient("127.0.0.1", 0, "", false, nil)
+	// one complete response with no byte after its blank line
+	c.recv_buf.WriteString("2\nok\n5\nhello\n\n")
+	resp, err := c.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 2 || resp[0] != "ok" || resp[1] != "hello" {
+		t.Fatalf("parse = %q, want [ok hello]", resp)
+	}
+	if c.recv_buf.Len() != 0 {
+		t.Fatalf("%d bytes left in recv_buf", c.recv_buf.Len())
+	}
+}
+
+func TestParseIncompleteResponse(t *testing.T) {
+	for _, data := range []string{
+		"2\nok\n5\nhello",     // value without its newline
+		"2\nok\n5\nhello\n",   // no blank line yet
+		"2\nok\n5\nhel",       // value cut
+		"2\nok\n5\nhello\n\r", // blank line cut after \r
+	} {
+		c := newClient("127.0.0.1", 0, "", false, nil)
+		c.recv_buf.WriteString(data)
+		resp, err := c.parse()
+		if err != nil || resp == nil || len(resp) != 0 {
+			t.Fatalf("parse(%q) = %q, %v, want need more data", data, resp, err)
+		}
+		if c.recv_buf.Len() != len(data) {
+			t.Fatalf("parse(%q) consumed an incomplete response", data)
+		}
+	}
+}
+
+// scriptServer answer every request with reply, which may sleep to play a slow server
+func scriptServer(t testing.TB, reply func(req []string) []string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveScript(t, ln, reply)
+	return ln.Addr().String()
+}
+
+// serveScript answer every request read on ln with reply until the test end
+func serveScript(t testing.TB, ln net.Listener, reply func(req []string) []string) {
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					req, err := readBlock(r)
+					if err != nil {
+						return
+					}
+					var out []byte
+					for _, v := range reply(req) {
+						out = append(out, strconv.Itoa(len(v))+"\n"+v+"\n"...)
+					}
+					if _, err := conn.Write(append(out, '\n')); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+}
+
+// readBlock read one length-prefixed request ended by a blank line
+func readBlock(r *bufio.Reader) ([]string, error) {
+	var req []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if line == "\n" {
+			return req, nil
+		}
+		size, err := strconv.Atoi(line[:len(line)-1])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+1)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		req = append(req, string(buf[:size]))
+	}
+}
+
+func TestTimeoutReplyNotSeenByNextCommand(t *testing.T) {
+	addr := scriptServer(t, func(req []string) []string {
+		if len(req) > 1 && req[1] == "slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		if len(req) > 1 {
+			return []string{"ok", req[1]}
+		}
+		return []string{"ok"}
+	})
+	c := connectAddr(t, addr, "")
+	c.SetCommandTimeout(50 * time.Millisecond)
+	if _, err := c.Do("get", "slow"); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("slow get = %v, want ErrTimeout", err)
+	}
+	c.SetCommandTimeout(time.Second)
+	// the connection of the timed-out command is dropped, its late reply never reach fast
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := c.Do("get", "fast")
+		if err == nil {
+			if len(resp) != 2 || resp[1] != "fast" {
+				t.Fatalf("get fast = %v, got another command reply", resp)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("get fast never succeeded: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// waitGoroutines wait for the goroutine count to go down to max, it return the last count
+func waitGoroutines(max int) int {
+	n := runtime.NumGoroutine()
+	for i := 0; i < 100 && n > max; i++ {
+		time.Sleep(20 * time.Millisecond)
+		n = runtime.NumGoroutine()
+	}
+	return n
+}
+
+func TestTimeoutStressGoroutinesBounded(t *testing.T) {
+	const callers, calls = 20, 50
+	addr := silentServer(t)
+	base := runtime.NumGoroutine()
+	host, port := splitAddr(t, addr)
+	c, err := Connect(host, port, "", false, nil, WithReconnectBackoff(time.Millisecond, 5*time.Millisecond, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetCommandTimeout(5 * time.Millisecond)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	peak, timeouts := 0, 0
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < calls; j++ {
+				_, err := c.Do("get", "a")
+				if err == nil {
+					t.Error("get on a silent server succeeded")
+					return
+				}
+				mu.Lock()
+				if errors.Is(err, ErrTimeout) {
+					timeouts++
+				}
+				if n := runtime.NumGoroutine(); n > peak {
+					peak = n
+				}
+				mu.Unlock()
+				// give the reconnect a chance so more commands reach the socket
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+	if timeouts == 0 {
+		t.Fatal("no command timed out")
+	}
+	// the callers, processDo and short lived reconnect goroutines, nothing grow with the calls
+	if peak > base+2*callers+10 {
+		t.Fatalf("goroutines peaked at %d for a base of %d after %d timeouts", peak, base, timeouts)
+	}
+	c.Close()
+	if n := waitGoroutines(base + 2); n > base+2 {
+		t.Fatalf("%d goroutines after Close, base %d", n, base)
+	}
+}
+
+func TestConcurrentSetGet(t *testing.T) {
+	c := connectMock(t)
+	const workers, rounds = 50, 20
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				key := "k" + strconv.Itoa(i)
+				want := strconv.Itoa(i) + "-" + strconv.Itoa(j)
+				if _, err := c.Set(key, want); err != nil {
+					t.Errorf("set %s: %v", key, err)
+					return
+				}
+				got, err := c.Get(key)
+				if err != nil {
+					t.Errorf("get %s: %v", key, err)
+					return
+				}
+				if got != want {
+					t.Errorf("get %s = %v, want %s", key, got, want)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestConcurrentBatchAppendExec(t *testing.T) {
+	c := connectMock(t)
+	const workers, per = 8, 25
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < per; j++ {
+				c.BatchAppend("set", "b"+strconv.Itoa(i)+"-"+strconv.Itoa(j), j)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := c.BatchLen(); n != workers*per {
+		t.Fatalf("BatchLen = %d, want %d", n, workers*per)
+	}
+	results, err := c.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != workers*per {
+		t.Fatalf("%d results, want %d", len(results), workers*per)
+	}
+	for i, r := range results {
+		if r.Error != nil {
+			t.Fatalf("result %d: %v", i, r.Error)
+		}
+	}
+	if n := c.BatchLen(); n != 0 {
+		t.Fatalf("BatchLen after Exec = %d", n)
+	}
+	for i := 0; i < workers; i++ {
+		for j := 0; j < per; j++ {
+			key := "b" + strconv.Itoa(i) + "-" + strconv.Itoa(j)
+			if got, err := c.Get(key); err != nil || got != strconv.Itoa(j) {
+				t.Fatalf("get %s = %v, %v", key, got, err)
+			}
+		}
+	}
+}
+
+func TestBatchSendKeepTail(t *testing.T) {
+	c := connectMock(t, WithBatchConns(3))
+	// two full chunks and a one command tail
+	const total = 2*2000 + 1
+	args := make([][]interface{}, total)
+	for i := range args {
+		args[i] = []interface{}{"set", "t" + strconv.Itoa(i), i}
+	}
+	failed, err := c.BatchSend(args, false, nil)
+	if err != nil || len(failed) > 0 {
+		t.Fatalf("BatchSend: %d failed, %v", len(failed), err)
+	}
+	for i := 0; i < total; i++ {
+		key := "t" + strconv.Itoa(i)
+		if got, err := c.Get(key); err != nil || got != strconv.Itoa(i) {
+			t.Fatalf("get %s = %v, %v", key, got, err)
+		}
+	}
+}
+
+type nameObserver struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (o *nameObserver) ObserveCommand(cmd string, dur time.Duration, err error) {
+	o.mu.Lock()
+	o.names = append(o.names, cmd)
+	o.mu.Unlock()
+}
+
+func TestBatchSendObservedName(t *testing.T) {
+	obs := &nameObserver{}
+	c := connectMock(t, WithObserver(obs))
+	args := [][]interface{}{{"set", "a", "secret"}, {"set", "b", 1}, {"set", "c", 2}}
+	if failed, err := c.BatchSend(args, false, nil); err != nil || len(failed) > 0 {
+		t.Fatalf("BatchSend: %d failed, %v", len(failed), err)
+	}
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	if len(obs.names) != len(args) {
+		t.Fatalf("observed %q, want %d commands", obs.names, len(args))
+	}
+	for _, name := range obs.names {
+		if name != "set" {
+			t.Fatalf("observed name %q, want set", name)
+		}
+	}
+}
+
+func TestHashMultiExistsWithConcurrentDo(t *testing.T) {
+	c := connectMock(t)
+	if _, err := c.HashSet("h", "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if i%2 == 0 {
+					got, err := c.HashMultiExists("h", []string{"a", "b"})
+					if err != nil || !got["a"] || got["b"] {
+						t.Errorf("HashMultiExists = %v, %v", got, err)
+						return
+					}
+					continue
+				}
+				key := "k" + strconv.Itoa(i)
+				if _, err := c.Set(key, "v"); err != nil {
+					t.Errorf("set: %v", err)
+					return
+				}
+				if got, err := c.Get(key); err != nil || got != "v" {
+					t.Errorf("get %s = %v, %v", key, got, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestPipeExecTimeout(t *testing.T) {
+	c := connectAddr(t, silentServer(t), "")
+	c.SetCommandTimeout(50 * time.Millisecond)
+	start := time.Now()
+	_, err := c.HashMultiExists("h", []string{"a", "b"})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("HashMultiExists on a silent server = %v, want ErrTimeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("HashMultiExists returned after %v", d)
+	}
+}
+
+func TestHashMultiSize(t *testing.T) {
+	c := connectMock(t)
+	for _, f := range []string{"a", "b", "c"} {
+		if _, err := c.HashSet("h3", f, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.HashSet("h1", "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.HashMultiSize([]string{"h3", "h1", "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["h3"] != 3 || got["h1"] != 1 || got["none"] != 0 || len(got) != 3 {
+		t.Fatalf("HashMultiSize = %v", got)
+	}
+}
+
+// TestIntHelpersBadResponse check the int helpers return an error instead of panic
+// when the server answer ok without the integer
+func TestIntHelpersBadResponse(t *testing.T) {
+	addr := scriptServer(t, func(req []string) []string {
+		return []string{"ok"}
+	})
+	c := connectAddr(t, addr, "")
+	calls := map[string]func() error{
+		"SetBit":     func() error { _, err := c.SetBit("k", 1, 1); return err },
+		"GetBit":     func() error { _, err := c.GetBit("k", 1); return err },
+		"CountBit":   func() error { _, err := c.CountBit("k", 0, 1); return err },
+		"BitCount":   func() error { _, err := c.BitCount("k", 0, 1); return err },
+		"Strlen":     func() error { _, err := c.Strlen("k"); return err },
+		"DBSize":     func() error { _, err := c.DBSize(); return err },
+		"ZRank":      func() error { _, err := c.ZRank("z", "k"); return err },
+		"ZRRank":     func() error { _, err := c.ZRRank("z", "k"); return err },
+		"ZCount":     func() error { _, err := c.ZCount("z", "", ""); return err },
+		"ZSum":       func() error { _, err := c.ZSum("z", "", ""); return err },
+		"QTrimFront": func() error { _, err := c.QTrimFront("q", 1); return err },
+		"QTrimBack":  func() error { _, err := c.QTrimBack("q", 1); return err },
+		"QPushBack":  func() error { _, err := c.QPushBack("q", "a"); return err },
+		"QPushFront": func() error { _, err := c.QPushFront("q", "a"); return err },
+	}
+	for name, call := range calls {
+		if err := call(); err == nil || !strings.Contains(err.Error(), "bad response") {
+			t.Errorf("%s = %v, want a bad response error", name, err)
+		}
+	}
+}
+
+func TestCloneInheritZip(t *testing.T) {
+	var mu sync.Mutex
+	var plain []string
+	zipped := 0
+	addr := scriptServer(t, func(req []string) []string {
+		mu.Lock()
+		if len(req) > 0 && req[0] == "zip" {
+			zipped++
+		} else {
+			plain = append(plain, req...)
+		}
+		mu.Unlock()
+		return []string{"ok", "1"}
+	})
+	c := connectAddr(t, addr, "")
+	c.UseZip(true)
+	child, err := c.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if !child.zip {
+		t.Fatal("the clone of a zipped client is not zipped")
+	}
+	if _, err := child.Do("set", "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// BatchSend run on clones of c
+	if _, err := c.BatchSend([][]interface{}{{"set", "b", "2"}, {"set", "c", "3"}}, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(plain) > 0 || zipped != 3 {
+		t.Fatalf("%d zipped commands, sent without zip: %v", zipped, plain)
+	}
+}
+
+func TestMultiHashSetCloneFailure(t *testing.T) {
+	addr, _ := ssdbtest.StartMockServerTB(t)
+	var mu sync.Mutex
+	dials := 0
+	dial := func(ctx context.Context, network, a string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		// c and one clone connect, the next clone fail
+		dials++
+		if dials > 2 {
+			return nil, errors.New("server down")
+		}
+		return new(net.Dialer).DialContext(ctx, network, addr)
+	}
+	c := connectAddr(t, addr, "", WithDialer(dial))
+	parts := []HashData{{HashName: "h", Key: "a", Value: "1"}, {HashName: "h", Key: "b", Value: "2"}, {HashName: "h", Key: "c", Value: "3"}}
+	if _, err := c.MultiHashSet(parts, 3, false, nil); err == nil {
+		t.Fatal("MultiHashSet with a failed clone succeeded")
+	}
+}
+
+func TestConnectContextFailedClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port := splitAddr(t, ln.Addr().String())
+	ln.Close()
+	// a refused dial hand back the client retrying in background
+	c, err := ConnectContext(context.Background(), host, port, "", false, nil)
+	if err == nil || c == nil {
+		t.Fatalf("refused dial = %v, %v, want a client and an error", c, err)
+	}
+	c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c, err = ConnectContext(ctx, host, port, "", false, nil)
+	if c != nil || !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled connect = %v, %v, want no client and context.Canceled", c, err)
+	}
+}
+
+func TestConnectIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no ipv6 loopback:", err)
+	}
+	serveScript(t, ln, func(req []string) []string {
+		return []string{"ok", "1"}
+	})
+	port := ln.Addr().(*net.TCPAddr).Port
+	c, err := Connect("::1", port, "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.addr(); got != "[::1]:"+strconv.Itoa(port) {
+		t.Fatalf("addr = %s", got)
+	}
+	if _, err := c.Do("ping"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFormatNestedArgs(t *testing.T) {
+	got, err := formatArg(1, []interface{}{"s", 7, int64(-8), 1.5, true, false, nil, []byte("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"s", "7", "-8", "1.500000", "1", "0", "", "b"}
+	if len(got) != len(want) {
+		t.Fatalf("formatArg = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("formatArg = %q, want %q", got, want)
+		}
+	}
+	for _, bad := range []interface{}{
+		[]interface{}{"a", struct{}{}},
+		[]interface{}{[]interface{}{"deeper"}},
+		[]interface{}{int32(1)},
+		map[string]string{},
+	} {
+		if _, err := formatArg(2, bad); !errors.Is(err, ErrBadArgument) {
+			t.Errorf("formatArg(%#v) = %v, want ErrBadArgument", bad, err)
+		}
+	}
+}
+
+func TestSendNestedArgs(t *testing.T) {
+	var mu sync.Mutex
+	var last []string
+	addr := scriptServer(t, func(req []string) []string {
+		mu.Lock()
+		last = req
+		mu.Unlock()
+		return []string{"ok", "1"}
+	})
+	c := connectAddr(t, addr, "")
+	if _, err := c.Do("multi_set", []interface{}{"i", 3, "f", 0.25, "b", true, "n", nil}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	got := strings.Join(last, ",")
+	mu.Unlock()
+	if want := "multi_set,i,3,f,0.250000,b,1,n,"; got != want {
+		t.Fatalf("server read %q, want %q", got, want)
+	}
+	// a bad nested value fail before anything is written
+	if _, err := c.Do("multi_set", []interface{}{"k", struct{}{}}); !errors.Is(err, ErrBadArgument) {
+		t.Fatalf("Do with a struct value = %v, want ErrBadArgument", err)
+	}
+	if _, err := c.Do("ping"); err != nil {
+		t.Fatalf("ping after the rejected command: %v", err)
+	}
+}
+
+func TestCloseStopGoroutines(t *testing.T) {
+	addr, _ := ssdbtest.StartMockServerTB(t)
+	base := runtime.NumGoroutine()
+	c := connectAddr(t, addr, "")
+	// a long interval, Close must not wait for it
+	c.KeepAliveEvery(time.Hour)
+	c.KeepAliveEvery(time.Hour)
+	if _, err := c.Do("ping"); err != nil {
+		t.Fatal(err)
+	}
+	if n := runtime.NumGoroutine(); n <= base {
+		t.Fatalf("%d goroutines with a connected client, base %d", n, base)
+	}
+	c.Close()
+	if n := waitGoroutines(base); n > base {
+		t.Fatalf("%d goroutines after Close, base %d", n, base)
+	}
+}
+
+// framingValues hold the bytes a line based parser would split on
+var framingValues = []string{"a\nb", "a\r\nb", "a\x00b", "\r\n", "\n\n", "end\r", "\x00", ""}
+
+func TestValueFramingRoundTrip(t *testing.T) {
+	c := connectMock(t)
+	for i, v := range framingValues {
+		key := "f" + strconv.Itoa(i)
+		if _, err := c.Set(key, v); err != nil {
+			t.Fatalf("set %q: %v", v, err)
+		}
+		got, err := c.Get(key)
+		if err != nil {
+			t.Fatalf("get %q: %v", v, err)
+		}
+		if got != v {
+			t.Fatalf("get = %q, want %q", got, v)
+		}
+	}
+}
+
+func TestZipValueFramingRoundTrip(t *testing.T) {
+	c := &Client{zip: true}
+	args := []interface{}{"multi_set"}
+	for _, v := range framingValues {
+		args = append(args, "k", v)
+	}
+	var buf bytes.Buffer
+	if err := c.encode(&buf, args); err != nil {
+		t.Fatal(err)
+	}
+	req, err := readBlock(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req) != 2 || req[0] != "zip" {
+		t.Fatalf("zipped request = %q", req)
+	}
+	data, err := c.UnZip(req[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := c.tranfUnZip(data)
+	if len(got) != len(args) {
+		t.Fatalf("unzipped %d values %q, want %d", len(got), got, len(args))
+	}
+	for i, arg := range args {
+		if got[i] != arg {
+			t.Fatalf("value %d = %q, want %q", i, got[i], arg)
+		}
+	}
+}
+
+func TestAuthPassword(t *testing.T) {
+	addr, _ := ssdbtest.StartMockServerAuthTB(t, "secret")
+	c := connectAddr(t, addr, "secret")
+	if _, err := c.Set("a", "1"); err != nil {
+		t.Fatalf("set after auth: %v", err)
+	}
+	if ok, err := c.Auth("secret"); !ok || err != nil {
+		t.Fatalf("Auth with the password = %v, %v", ok, err)
+	}
+	if ok, err := c.Auth("wrong"); ok || err == nil {
+		t.Fatalf("Auth with a wrong password = %v, %v", ok, err)
+	}
+
+	host, port := splitAddr(t, addr)
+	bad, err := Connect(host, port, "wrong", false, nil)
+	if bad != nil {
+		bad.Close()
+		t.Fatal("Connect with a wrong password returned a client")
+	}
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("Connect with a wrong password = %v, want ErrAuthFailed", err)
+	}
+}
+
+// trickleConn write at most max bytes per Write call, like a congested socket
+type trickleConn struct {
+	net.Conn
+	max    int
+	writes int
+}
+
+func (c *trickleConn) Write(p []byte) (int, error) {
+	c.writes++
+	if len(p) > c.max {
+		p = p[:c.max]
+	}
+	return c.Conn.Write(p)
+}
+
+// stuckWriter accept nothing and report no error
+type stuckWriter struct{}
+
+func (stuckWriter) Write(p []byte) (int, error) {
+	return 0, nil
+}
+
+func TestWriteFullShortWrites(t *testing.T) {
+	if err := writeFull(stuckWriter{}, []byte("abc")); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("writeFull on a stuck writer = %v, want io.ErrShortWrite", err)
+	}
+	addr, _ := ssdbtest.StartMockServerTB(t)
+	var tc *trickleConn
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := new(net.Dialer).DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		tc = &trickleConn{Conn: conn, max: 3}
+		return tc, nil
+	}
+	c := connectAddr(t, addr, "", WithDialer(dial))
+	val := strings.Repeat("v", 100)
+	if _, err := c.Set("k", val); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Get("k"); err != nil || got != val {
+		t.Fatalf("get = %v, %v", got, err)
+	}
+	// the set alone is over 100 bytes, it need many 3 byte writes
+	if tc.writes < 40 {
+		t.Fatalf("%d writes, the command was not split", tc.writes)
+	}
+}
+
+// BenchmarkMultiModeWriteBuffer compare MultiMode writing once per command and through WithWriteBuffer,
+// every op send 1000 sets
+func BenchmarkMultiModeWriteBuffer(b *testing.B) {
+	args := make([][]interface{}, 1000)
+	for i := range args {
+		args[i] = []interface{}{"set", "bench" + strconv.Itoa(i), "value"}
+	}
+	for _, size := range []int{0, 64 << 10} {
+		name := "unbuffered"
+		if size > 0 {
+			name = strconv.Itoa(size>>10) + "KB"
+		}
+		b.Run(name, func(b *testing.B) {
+			c := connectMock(b, WithWriteBuffer(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.MultiMode(args); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPartialDeadline(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		left      time.Duration
+		remaining int
+		want      time.Duration
+	}{
+		{30 * time.Second, 3, 10 * time.Second},
+		{30 * time.Second, 1, 30 * time.Second},
+		// never under minDialShare
+		{3 * time.Second, 3, minDialShare},
+		// but never past the deadline
+		{time.Second, 2, time.Second},
+	}
+	for _, tc := range cases {
+		got := partialDeadline(now, now.Add(tc.left), tc.remaining).Sub(now)
+		if got != tc.want {
+			t.Errorf("partialDeadline(%v, %d) = %v, want %v", tc.left, tc.remaining, got, tc.want)
+		}
+	}
+}
+
+func TestDialerGetConnectDeadline(t *testing.T) {
+	addr, _ := ssdbtest.StartMockServerTB(t)
+	var hasDeadline bool
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		_, hasDeadline = ctx.Deadline()
+		return new(net.Dialer).DialContext(ctx, network, address)
+	}
+	c := connectAddr(t, addr, "", WithDialer(dial))
+	if !hasDeadline {
+		t.Fatal("the dialer ctx has no deadline")
+	}
+	if _, err := c.Do("ping"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a dialer stuck until its ctx end is bound by the connect timeout
+	stuck := func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	host, port := splitAddr(t, addr)
+	start := time.Now()
+	c, err := Connect(host, port, "", false, nil, WithDialer(stuck), WithDialTimeout(100*time.Millisecond))
+	if c != nil {
+		c.Close()
+	}
+	if err == nil {
+		t.Fatal("Connect through a stuck dialer succeeded")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Connect through a stuck dialer returned after %v", d)
+	}
+}
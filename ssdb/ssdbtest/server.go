@@ -0,0 +1,511 @@
+// Package ssdbtest provide an in-process server speaking the ssdb wire protocol,
+// it keep kv and hash data in memory so the client can be exercised without a real ssdb.
+package ssdbtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type mockServer struct {
+	ln       net.Listener
+	password string
+	mu       sync.Mutex
+	kv       map[string]string
+	hashes   map[string]map[string]string
+	zsets    map[string]map[string]int64
+	queues   map[string][]string
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// StartMockServer listen on a random local port and return its "host:port" address,
+// stop close the listener and every open connection, calling it again do nothing.
+// It panics when it can not listen, like httptest.NewServer
+func StartMockServer() (addr string, stop func()) {
+	return StartMockServerAuth("")
+}
+
+// StartMockServerAuth is StartMockServer with a server requiring password,
+// a connection must auth with it before any other command like a real ssdb
+func StartMockServerAuth(password string) (addr string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("ssdbtest: listen failed: %v", err))
+	}
+	s := &mockServer{
+		ln:       ln,
+		password: password,
+		kv:       make(map[string]string),
+		hashes:   make(map[string]map[string]string),
+		zsets:    make(map[string]map[string]int64),
+		queues:   make(map[string][]string),
+		conns:    make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	var once sync.Once
+	stop = func() {
+		once.Do(s.stop)
+	}
+	return ln.Addr().String(), stop
+}
+
+// TB is the part of testing.TB used by the helpers below, *testing.T and *testing.B satisfy it
+// without this package importing testing
+type TB interface {
+	Helper()
+	Cleanup(func())
+}
+
+// StartMockServerTB is StartMockServer with stop also run by tb.Cleanup
+func StartMockServerTB(tb TB) (addr string, stop func()) {
+	return StartMockServerAuthTB(tb, "")
+}
+
+// StartMockServerAuthTB is StartMockServerAuth with stop also run by tb.Cleanup
+func StartMockServerAuthTB(tb TB, password string) (addr string, stop func()) {
+	tb.Helper()
+	addr, stop = StartMockServerAuth(password)
+	tb.Cleanup(stop)
+	return addr, stop
+}
+
+func (s *mockServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *mockServer) stop() {
+	s.ln.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *mockServer) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	authed := s.password == ""
+	for {
+		req, err := readRequest(r)
+		if err != nil {
+			return
+		}
+		if len(req) == 0 {
+			continue
+		}
+		var resp []string
+		switch {
+		case req[0] == "auth":
+			resp = s.auth(req[1:], &authed)
+		case !authed:
+			resp = []string{"noauth", "authentication required"}
+		case req[0] == "batchexec":
+			resp = s.batchexec(req[1:])
+		default:
+			resp = s.exec(req)
+		}
+		if _, err := conn.Write(encode(resp)); err != nil {
+			return
+		}
+	}
+}
+
+// readRequest read one length-prefixed block ended by an empty line
+func readRequest(r *bufio.Reader) ([]string, error) {
+	var req []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return req, nil
+		}
+		size, err := strconv.Atoi(line)
+		if err != nil || size < 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		buf := make([]byte, size+1)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		req = append(req, string(buf[:size]))
+	}
+}
+
+func encode(resp []string) []byte {
+	var buf bytes.Buffer
+	for _, s := range resp {
+		buf.WriteString(strconv.Itoa(len(s)))
+		buf.WriteByte('\n')
+		buf.WriteString(s)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func boolString(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// inRange keep the ssdb range rule (start, end], an empty bound is open
+func inRange(key string, start string, end string) bool {
+	return (start == "" || key > start) && (end == "" || key <= end)
+}
+
+func rangeKeys(keys []string, args []string) []string {
+	if len(args) < 3 {
+		return nil
+	}
+	limit, _ := strconv.Atoi(args[2])
+	sort.Strings(keys)
+	var out []string
+	for _, k := range keys {
+		if limit >= 0 && len(out) >= limit {
+			break
+		}
+		if inRange(k, args[0], args[1]) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// auth check the password like ssdb, a server without password accept any auth
+func (s *mockServer) auth(args []string, authed *bool) []string {
+	if len(args) < 1 {
+		return []string{"client_error", "wrong number of arguments"}
+	}
+	if s.password != "" && args[0] != s.password {
+		*authed = false
+		return []string{"error", "invalid password"}
+	}
+	*authed = true
+	return []string{"ok", "1"}
+}
+
+func (s *mockServer) exec(req []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd, args := req[0], req[1:]
+	need := func(n int) bool {
+		return len(args) >= n
+	}
+	switch cmd {
+	case "ping":
+		return []string{"ok", "1"}
+	case "set", "setx":
+		if !need(2) {
+			break
+		}
+		s.kv[args[0]] = args[1]
+		return []string{"ok", "1"}
+	case "setnx":
+		if !need(2) {
+			break
+		}
+		if _, ok := s.kv[args[0]]; ok {
+			return []string{"ok", "0"}
+		}
+		s.kv[args[0]] = args[1]
+		return []string{"ok", "1"}
+	case "get":
+		if !need(1) {
+			break
+		}
+		if v, ok := s.kv[args[0]]; ok {
+			return []string{"ok", v}
+		}
+		return []string{"not_found"}
+	case "del":
+		if !need(1) {
+			break
+		}
+		delete(s.kv, args[0])
+		return []string{"ok", "1"}
+	case "exists":
+		if !need(1) {
+			break
+		}
+		_, ok := s.kv[args[0]]
+		return []string{"ok", boolString(ok)}
+	case "expire":
+		if !need(1) {
+			break
+		}
+		_, ok := s.kv[args[0]]
+		return []string{"ok", boolString(ok)}
+	case "incr":
+		if !need(1) {
+			break
+		}
+		by := int64(1)
+		if need(2) {
+			by, _ = strconv.ParseInt(args[1], 10, 64)
+		}
+		cur, _ := strconv.ParseInt(s.kv[args[0]], 10, 64)
+		s.kv[args[0]] = strconv.FormatInt(cur+by, 10)
+		return []string{"ok", s.kv[args[0]]}
+	case "keys", "scan":
+		keys := make([]string, 0, len(s.kv))
+		for k := range s.kv {
+			keys = append(keys, k)
+		}
+		resp := []string{"ok"}
+		for _, k := range rangeKeys(keys, args) {
+			resp = append(resp, k)
+			if cmd == "scan" {
+				resp = append(resp, s.kv[k])
+			}
+		}
+		return resp
+	case "multi_del":
+		n := 0
+		for _, k := range args {
+			if _, ok := s.kv[k]; ok {
+				delete(s.kv, k)
+				n++
+			}
+		}
+		return []string{"ok", strconv.Itoa(n)}
+	case "dbsize":
+		return []string{"ok", strconv.Itoa(len(s.kv))}
+	case "hset":
+		if !need(3) {
+			break
+		}
+		h, ok := s.hashes[args[0]]
+		if !ok {
+			h = make(map[string]string)
+			s.hashes[args[0]] = h
+		}
+		_, exist := h[args[1]]
+		h[args[1]] = args[2]
+		return []string{"ok", boolString(!exist)}
+	case "hget":
+		if !need(2) {
+			break
+		}
+		if v, ok := s.hashes[args[0]][args[1]]; ok {
+			return []string{"ok", v}
+		}
+		return []string{"not_found"}
+	case "hdel":
+		if !need(2) {
+			break
+		}
+		_, ok := s.hashes[args[0]][args[1]]
+		delete(s.hashes[args[0]], args[1])
+		if len(s.hashes[args[0]]) == 0 {
+			delete(s.hashes, args[0])
+		}
+		return []string{"ok", boolString(ok)}
+	case "hkeys":
+		if !need(4) {
+			break
+		}
+		keys := make([]string, 0, len(s.hashes[args[0]]))
+		for k := range s.hashes[args[0]] {
+			keys = append(keys, k)
+		}
+		return append([]string{"ok"}, rangeKeys(keys, args[1:])...)
+	case "multi_hget":
+		if !need(1) {
+			break
+		}
+		resp := []string{"ok"}
+		for _, k := range args[1:] {
+			if v, ok := s.hashes[args[0]][k]; ok {
+				resp = append(resp, k, v)
+			}
+		}
+		return resp
+	case "hexists":
+		if !need(2) {
+			break
+		}
+		_, ok := s.hashes[args[0]][args[1]]
+		return []string{"ok", boolString(ok)}
+	case "hsize":
+		if !need(1) {
+			break
+		}
+		return []string{"ok", strconv.Itoa(len(s.hashes[args[0]]))}
+	case "hclear":
+		if !need(1) {
+			break
+		}
+		n := len(s.hashes[args[0]])
+		delete(s.hashes, args[0])
+		return []string{"ok", strconv.Itoa(n)}
+	case "hlist":
+		names := make([]string, 0, len(s.hashes))
+		for name := range s.hashes {
+			names = append(names, name)
+		}
+		return append([]string{"ok"}, rangeKeys(names, args)...)
+	case "zset":
+		if !need(3) {
+			break
+		}
+		score, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return []string{"client_error", "invalid score"}
+		}
+		z, ok := s.zsets[args[0]]
+		if !ok {
+			z = make(map[string]int64)
+			s.zsets[args[0]] = z
+		}
+		_, exist := z[args[1]]
+		z[args[1]] = score
+		return []string{"ok", boolString(!exist)}
+	case "zdel":
+		if !need(2) {
+			break
+		}
+		_, ok := s.zsets[args[0]][args[1]]
+		delete(s.zsets[args[0]], args[1])
+		if len(s.zsets[args[0]]) == 0 {
+			delete(s.zsets, args[0])
+		}
+		return []string{"ok", boolString(ok)}
+	case "zscan":
+		if !need(5) {
+			break
+		}
+		return append([]string{"ok"}, s.zscan(args)...)
+	case "qpush_back", "qpush":
+		if !need(2) {
+			break
+		}
+		s.queues[args[0]] = append(s.queues[args[0]], args[1:]...)
+		return []string{"ok", strconv.Itoa(len(s.queues[args[0]]))}
+	case "qpush_front":
+		if !need(2) {
+			break
+		}
+		q := s.queues[args[0]]
+		for _, item := range args[1:] {
+			q = append([]string{item}, q...)
+		}
+		s.queues[args[0]] = q
+		return []string{"ok", strconv.Itoa(len(q))}
+	case "qsize":
+		if !need(1) {
+			break
+		}
+		return []string{"ok", strconv.Itoa(len(s.queues[args[0]]))}
+	default:
+		return []string{"client_error", "Unknown Command: " + cmd}
+	}
+	return []string{"client_error", "wrong number of arguments"}
+}
+
+// batchexec run every command of the json batch in order and return their responses as json,
+// a batch starting with "async" only get "ok"
+func (s *mockServer) batchexec(args []string) []string {
+	if len(args) != 1 {
+		return []string{"client_error", "wrong number of arguments"}
+	}
+	d := json.NewDecoder(strings.NewReader(args[0]))
+	d.UseNumber()
+	var batch [][]interface{}
+	if err := d.Decode(&batch); err != nil {
+		return []string{"client_error", "bad batch: " + err.Error()}
+	}
+	async := false
+	if len(batch) > 0 && len(batch[0]) > 0 && batch[0][0] == "async" {
+		async = true
+		batch = batch[1:]
+	}
+	resps := make([][]string, 0, len(batch))
+	for _, cmd := range batch {
+		req := make([]string, len(cmd))
+		for i, v := range cmd {
+			req[i] = fmt.Sprint(v)
+		}
+		if len(req) == 0 {
+			resps = append(resps, []string{"client_error", "empty command"})
+			continue
+		}
+		resps = append(resps, s.exec(req))
+	}
+	if async {
+		return []string{"ok"}
+	}
+	out, _ := json.Marshal(resps)
+	return []string{"ok", string(out)}
+}
+
+// zscan follow the ssdb order (score, key) and its bounds: score_start and score_end
+// are inclusive, key_start only skip the members of score_start up to that key
+func (s *mockServer) zscan(args []string) []string {
+	z := s.zsets[args[0]]
+	keys := make([]string, 0, len(z))
+	for k := range z {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if z[keys[i]] != z[keys[j]] {
+			return z[keys[i]] < z[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	limit, _ := strconv.Atoi(args[4])
+	var out []string
+	for _, k := range keys {
+		if limit >= 0 && len(out)/2 >= limit {
+			break
+		}
+		score := z[k]
+		if args[2] != "" {
+			start, _ := strconv.ParseInt(args[2], 10, 64)
+			if score < start || (score == start && args[1] != "" && k <= args[1]) {
+				continue
+			}
+		}
+		if args[3] != "" {
+			end, _ := strconv.ParseInt(args[3], 10, 64)
+			if score > end {
+				continue
+			}
+		}
+		out = append(out, k, strconv.FormatInt(score, 10))
+	}
+	return out
+}
@@ -0,0 +1,142 @@
+package ssdbtest
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// do send one raw command and read its response with the server own framing
+func do(t *testing.T, conn net.Conn, r *bufio.Reader, args ...string) []string {
+	t.Helper()
+	if _, err := conn.Write(encode(args)); err != nil {
+		t.Fatalf("write %v: %v", args, err)
+	}
+	resp, err := readRequest(r)
+	if err != nil {
+		t.Fatalf("read %v: %v", args, err)
+	}
+	return resp
+}
+
+func dial(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+func TestAuth(t *testing.T) {
+	addr, stop := StartMockServerAuth("secret")
+	defer stop()
+	conn, r := dial(t, addr)
+	if resp := do(t, conn, r, "get", "a"); resp[0] != "noauth" {
+		t.Fatalf("get before auth = %v, want noauth", resp)
+	}
+	if resp := do(t, conn, r, "auth", "wrong"); resp[0] != "error" {
+		t.Fatalf("auth with wrong password = %v, want error", resp)
+	}
+	if resp := do(t, conn, r, "auth", "secret"); !reflect.DeepEqual(resp, []string{"ok", "1"}) {
+		t.Fatalf("auth = %v, want [ok 1]", resp)
+	}
+	if resp := do(t, conn, r, "get", "a"); resp[0] != "not_found" {
+		t.Fatalf("get after auth = %v, want not_found", resp)
+	}
+}
+
+func TestAuthWithoutPassword(t *testing.T) {
+	addr, stop := StartMockServer()
+	defer stop()
+	conn, r := dial(t, addr)
+	if resp := do(t, conn, r, "set", "a", "1"); resp[0] != "ok" {
+		t.Fatalf("set without auth = %v, want ok", resp)
+	}
+	if resp := do(t, conn, r, "auth", "any"); resp[0] != "ok" {
+		t.Fatalf("auth = %v, want ok", resp)
+	}
+}
+
+func TestMultiDelCountDeleted(t *testing.T) {
+	addr, stop := StartMockServer()
+	defer stop()
+	conn, r := dial(t, addr)
+	do(t, conn, r, "set", "a", "1")
+	do(t, conn, r, "set", "b", "2")
+	if resp := do(t, conn, r, "multi_del", "a", "b", "missing"); !reflect.DeepEqual(resp, []string{"ok", "2"}) {
+		t.Fatalf("multi_del = %v, want [ok 2]", resp)
+	}
+}
+
+func TestScanRange(t *testing.T) {
+	addr, stop := StartMockServer()
+	defer stop()
+	conn, r := dial(t, addr)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		do(t, conn, r, "set", k, k+"v")
+	}
+	want := []string{"ok", "b", "bv", "c", "cv"}
+	if resp := do(t, conn, r, "scan", "a", "c", "10"); !reflect.DeepEqual(resp, want) {
+		t.Fatalf("scan = %v, want %v", resp, want)
+	}
+}
+
+func TestZScanScoreOrder(t *testing.T) {
+	addr, stop := StartMockServer()
+	defer stop()
+	conn, r := dial(t, addr)
+	do(t, conn, r, "zset", "z", "late", "30")
+	do(t, conn, r, "zset", "z", "early", "10")
+	do(t, conn, r, "zset", "z", "mid", "20")
+	want := []string{"ok", "early", "10", "mid", "20"}
+	if resp := do(t, conn, r, "zscan", "z", "", "", "20", "10"); !reflect.DeepEqual(resp, want) {
+		t.Fatalf("zscan = %v, want %v", resp, want)
+	}
+}
+
+func TestStopCloseConnections(t *testing.T) {
+	addr, stop := StartMockServer()
+	_, r := dial(t, addr)
+	stop()
+	if _, err := r.ReadByte(); err == nil {
+		t.Fatal("connection still open after stop")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("listener still accepting after stop")
+	}
+	stop()
+}
+
+func TestBatchExec(t *testing.T) {
+	addr, stop := StartMockServer()
+	defer stop()
+	conn, r := dial(t, addr)
+	resp := do(t, conn, r, "batchexec", `[["set","a",1],["get","a"],["nope"]]`)
+	want := `[["ok","1"],["ok","1"],["client_error","Unknown Command: nope"]]`
+	if len(resp) != 2 || resp[0] != "ok" || resp[1] != want {
+		t.Fatalf("batchexec = %q", resp)
+	}
+	if resp := do(t, conn, r, "batchexec", `[["async"],["set","b","2"]]`); len(resp) != 1 || resp[0] != "ok" {
+		t.Fatalf("async batchexec = %q", resp)
+	}
+	if resp := do(t, conn, r, "get", "b"); resp[1] != "2" {
+		t.Fatalf("get b after async batch = %q", resp)
+	}
+}
+
+func TestStartMockServerTBCleanup(t *testing.T) {
+	var addr string
+	t.Run("server", func(t *testing.T) {
+		addr, _ = StartMockServerTB(t)
+		conn, r := dial(t, addr)
+		if resp := do(t, conn, r, "set", "a", "1"); resp[0] != "ok" {
+			t.Fatalf("set = %v, want ok", resp)
+		}
+	})
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("listener still accepting after the test cleanup")
+	}
+}